@@ -4,15 +4,22 @@ import (
 	"fmt"
 	"math/rand"
 	"net/http"
-	"reflect"
+	"strings"
 	"time"
 
-	"github.com/form3tech-oss/jwt-go"
 	"github.com/franklyner/ssf/server"
 )
 
 const PREFIX = "/min"
 
+// ConfigJWTIssuer is the issuer of the tokens accepted by the JWTController
+const ConfigJWTIssuer = "jwt_issuer"
+
+const defaultJWTIssuer = "https://login.dev.maxbrain.io/"
+
+// bcrypt hash of admin-password
+const adminPasswordHash = "$2a$10$qWDc8FTMl1Q5Zj8c1bB2WurZM63.MiGZXAnSyYCfmoiOwzUTzT4ym"
+
 var (
 	ConfigProperties []string = []string{server.ConfigPort, server.ConfigReadTimeout, server.ConfigWriteTimeout, "name"}
 )
@@ -36,17 +43,24 @@ func generateOtherMetric(srv *server.Server) {
 }
 
 func initServer(config server.Config) *server.Server {
+	issuer := config.Get(ConfigJWTIssuer)
+	if issuer == "" {
+		issuer = defaultJWTIssuer
+	}
 	ctrProviders := []server.ControllerProvider{minControllerProvider{
-		Name: config.Get("name"),
+		Name:      config.Get("name"),
+		JWTIssuer: issuer,
 	}}
 
-	server := server.CreateServerWithPrefix(config, ctrProviders, PREFIX)
-	server.RegisterService("hello", helloService{})
-	return server
+	srv := server.CreateServerWithPrefix(config, ctrProviders, PREFIX)
+	server.Provide(srv, &helloService{})
+	srv.EnableLogLevelAdmin(SecuredControlller.AuthFunc)
+	return srv
 }
 
 type minControllerProvider struct {
-	Name string
+	Name      string
+	JWTIssuer string
 }
 
 func (m minControllerProvider) GetControllers() []server.Controller {
@@ -77,8 +91,44 @@ func (m minControllerProvider) GetControllers() []server.Controller {
 			IsSecured:      true,
 			Path:           "/jwt.html",
 			ControllerFunc: jwtController,
-			AuthFunc:       server.GetJwtAuth("https://login.dev.maxbrain.io/", claimsValidator),
-			Description:    "Authenticates using a jwt",
+			AuthFunc: server.GetJwtAuthWithOptions(server.JWTOptions{
+				Issuers:   []string{m.JWTIssuer},
+				Audiences: []string{"https://cockpit.maxbrain.io/api/"},
+			}),
+			Description: "Authenticates using a jwt",
+		},
+		{
+			Name:      "APIKeyController",
+			Metric:    "APIKeyController",
+			Methods:   []string{"GET"},
+			IsSecured: true,
+			Path:      "/apikey.html",
+			ControllerFunc: func(ctx *server.Context) {
+				p := ctx.Principal()
+				ctx.SendHTMLResponse(http.StatusOK, []byte(fmt.Sprintf("Hello %s, authenticated with %s!", p.Subject, p.AuthMethod)))
+			},
+			AuthFunc: server.AnyOf(
+				server.GetAPIKeyAuthFromHeader("X-API-Key", server.StaticAPIKeys{"minimal": "minimal-api-key"}),
+				server.GetBasicAuth("minimal", server.BasicAuthUsers{"admin": adminPasswordHash}),
+			),
+			Description: "Authenticates with an API key or basic auth",
+		},
+		{
+			Name:      "SignedController",
+			Metric:    "SignedController",
+			Methods:   []string{"POST"},
+			IsSecured: true,
+			Path:      "/signed",
+			ControllerFunc: func(ctx *server.Context) {
+				body, err := ctx.GetRequestBody()
+				if err != nil {
+					ctx.SendJsonError(err)
+					return
+				}
+				ctx.SendJSONResponse(http.StatusOK, body)
+			},
+			AuthFunc:    server.GetHMACAuth(server.StaticHMACSecrets{"minimal": "minimal-hmac-secret"}, server.HMACOptions{}),
+			Description: "Echoes the body of requests signed with server.SignRequest",
 		},
 		{
 			Name:           "LogLevelController",
@@ -88,6 +138,24 @@ func (m minControllerProvider) GetControllers() []server.Controller {
 			Path:           "/loglevel",
 			ControllerFunc: logController,
 		},
+		{
+			Name:           "GreetingController",
+			Metric:         "GreetingController",
+			Methods:        []string{"POST"},
+			IsSecured:      false,
+			Path:           "/greeting/{lang}",
+			ControllerFunc: greetingController,
+			Description:    "Binds and validates the request into a struct",
+		},
+		{
+			Name:           "UserController",
+			Metric:         "UserController",
+			Methods:        []string{"GET"},
+			IsSecured:      false,
+			Path:           "/users/{id}",
+			ControllerFunc: userController,
+			Description:    "Reads the numeric user id from the path",
+		},
 		{
 			Name:            "SubpathHandler",
 			Metric:          "SubpathHandler",
@@ -140,43 +208,25 @@ var SecuredControlller server.Controller = server.Controller{
 }
 
 func service(ctx *server.Context) {
-	helloSrv := ctx.GetService("hello").(helloService)
+	helloSrv, err := server.Resolve[*helloService](ctx)
+	if err != nil {
+		ctx.SendJsonError(err)
+		return
+	}
 	ctrp := ctx.ControllerProvider.(minControllerProvider)
 	ctx.SendHTMLResponse(200, []byte(helloSrv.sayHello(ctrp.Name)))
 }
 
 func jwtController(ctx *server.Context) {
-	token := ctx.Request.Context().Value("user").(*jwt.Token)
-	claims := token.Claims.(jwt.MapClaims)
-
-	ctx.SendHTMLResponse(http.StatusOK, []byte(fmt.Sprintf("Received token with following claims: %+v", claims)))
-}
-
-func claimsValidator(claims jwt.MapClaims) error {
-	audiences := claims["aud"]
-	fmt.Printf(reflect.TypeOf(audiences).String())
-	switch audiences.(type) {
-	case string:
-		if audiences != "https://cockpit.maxbrain.io/api/" {
-			return fmt.Errorf("token contains wrong audience: %s", audiences)
-		}
-	case []interface{}:
-		for _, aud := range audiences.([]interface{}) {
-			if aud.(string) == "https://cockpit.maxbrain.io/api/" {
-				return nil
-			}
-		}
-		return fmt.Errorf("correct audience not found in token")
-	default:
-		return fmt.Errorf("aud claim of unexpected type: %T", audiences)
-	}
-	return nil
+	principal := ctx.Principal()
+	ctx.SendHTMLResponse(http.StatusOK, []byte(fmt.Sprintf("Received token of %s with following claims: %+v", principal.Subject, principal.Claims)))
 }
 
 func logController(ctx *server.Context) {
 	ctx.LogDebug("This is a debug message")
 	ctx.LogInfo("This is an info message")
 	ctx.LogError("This is an error message")
+	ctx.Logger().Info("This is a structured message", "custom_field", 42)
 	ctx.SendHTMLResponse(http.StatusOK, []byte("Check your logfile!"))
 }
 
@@ -184,3 +234,36 @@ func subPathController(ctx *server.Context) {
 	ctx.SendHTMLResponse(http.StatusOK, []byte(ctx.Request.URL.String()))
 
 }
+
+type greetingRequest struct {
+	Lang     string `json:"-" path:"lang" validate:"required,enum=en|de"`
+	Name     string `json:"name" validate:"required,min=2,max=20"`
+	Times    *int   `json:"-" query:"times" validate:"min=1,max=3"`
+	Greeting string `json:"-" header:"X-Greeting" validate:"regex=^[A-Za-z]+$"`
+}
+
+func greetingController(ctx *server.Context) {
+	req, err := server.Bind[greetingRequest](ctx)
+	if err != nil {
+		ctx.SendJsonError(err)
+		return
+	}
+	greeting := req.Greeting
+	if greeting == "" {
+		greeting = map[string]string{"en": "Hello", "de": "Hallo"}[req.Lang]
+	}
+	times := 1
+	if req.Times != nil {
+		times = *req.Times
+	}
+	ctx.SendHTMLResponse(http.StatusOK, []byte(strings.Repeat(fmt.Sprintf("%s %s! ", greeting, req.Name), times)))
+}
+
+func userController(ctx *server.Context) {
+	id, err := ctx.PathParamInt("id")
+	if err != nil {
+		ctx.SendJsonError(err)
+		return
+	}
+	ctx.SendHTMLResponse(http.StatusOK, []byte(fmt.Sprintf("User %d", id)))
+}
@@ -1,14 +1,40 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/franklyner/ssf/server"
+	"github.com/franklyner/ssf/server/servertest"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
 )
 
 var (
@@ -102,24 +128,50 @@ func TestStatusController(t *testing.T) {
 }
 
 func TestJWKValidation(t *testing.T) {
-	jwt := "Bearer eyJhbGciOiJSUzI1NiIsImtpZCI6InIwTllfTFBiNWxKc0dRPT0iLCJ0eXAiOiJKV1QifQ.eyJhdWQiOlsiaHR0cHM6Ly9jb2NrcGl0Lm1heGJyYWluLmlvL2FwaS8iXSwiZXhwIjoxNzUyMDY2OTYxLCJpYXQiOjE3NTIwNjMzNjEsImlzcyI6Imh0dHBzOi8vbG9naW4uZGV2Lm1heGJyYWluLmlvLyIsImh0dHBzOi8vbWF4YnJhaW4uaW8vdXNlcl9lbWFpbCI6ImZyYW5rLmx5bmVyQG1heGJyYWluLmNvbSIsImh0dHBzOi8vbWF4YnJhaW4uaW8vdGVuYW50X2lkIjoiMTA4IiwiaHR0cHM6Ly9tYXhicmFpbi5pby90ZW5hbnRfc3ViZG9tYWluIjoiZGV2b3NhdXJ1cyIsImh0dHBzOi8vbWF4YnJhaW4uaW8vaXNfY29ja3BpdF91c2VyIjp0cnVlLCJodHRwczovL21heGJyYWluLmlvL2lkZW50aXR5X2lkIjoiM2M1YjBjZDMtNTQ0OS0xMWVkLTkzNDQtMDAxNjNlOGI5YzY3In0.Gi-P285mr1iSNNtpPxue8am1E4ULEL0nlFZbJHjgX2mPOEkV4q6EBDSN0pU-exgJgxJf3vkrq9xZYt5dt1hzdHgP5mzq-0ocRtk3Gd9zxkVKi0EnvDroQyldoigOJ-GtBdDMvUmUje2wh6Nuw4HSrEjvutZ-UyqLy3GN-QecngatD6VqAA5Q0QScbxRo7U-6YZmW2jUwwyr5TLhhUwW6Fllc4BDGqTopfBNm_qH-PRqS900upaMXMmU4SeBnKLz0d9d7DLwVDWhnVZP75VG74ipaZ2FebVy53f4lFRFOuG2QyuOSfM7J_WEzQncv3KvTLMUY2dRiwL4jdX6NTNCWew"
-	request := httptest.NewRequest("GET", PREFIX+"/jwt.html", nil)
-	request.Header.Add("x-request-id", "request-id-from-header")
-	request.Header.Add("Authorization", jwt)
-	responseRecorder := httptest.NewRecorder()
+	issuer := servertest.NewIssuer()
+	defer issuer.Close()
+	config := server.CreateConfig("./", "minimal", ConfigProperties)
+	config.SetProperty(ConfigJWTIssuer, issuer.URL)
+	srv := initServer(config)
 
-	serv.GetMainHandler().ServeHTTP(responseRecorder, request)
-	if responseRecorder.Code != 200 {
-		t.Errorf("JWTController returned code %d. Expected 200", responseRecorder.Code)
+	valid, err := issuer.Token(servertest.Claims{"sub": "user-1", "aud": []string{"https://cockpit.maxbrain.io/api/"}})
+	if err != nil {
+		t.Fatal(err)
 	}
-	request = httptest.NewRequest("GET", PREFIX+"/jwt.html", nil)
-	request.Header.Add("x-request-id", "request-id-from-header")
-	request.Header.Add("Authorization", jwt)
-	responseRecorder = httptest.NewRecorder()
+	expired, _ := issuer.Token(servertest.Claims{"sub": "user-1", "aud": "https://cockpit.maxbrain.io/api/", "exp": time.Now().Add(-time.Minute).Unix()})
+	wrongAudience, _ := issuer.Token(servertest.Claims{"sub": "user-1", "aud": "https://other.maxbrain.io/api/"})
+	otherIssuer, _ := issuer.Token(servertest.Claims{"sub": "user-1", "aud": "https://cockpit.maxbrain.io/api/", "iss": "https://login.dev.maxbrain.io/"})
+	foreignKey, _ := servertest.NewKey("RS256")
+	foreignKey.ID = issuer.Key().ID
+	forged, _ := issuer.TokenWithKey(foreignKey, servertest.Claims{"sub": "user-1", "aud": "https://cockpit.maxbrain.io/api/"})
 
-	serv.GetMainHandler().ServeHTTP(responseRecorder, request)
-	if responseRecorder.Code != 200 {
-		t.Errorf("JWTController returned code %d. Expected 200", responseRecorder.Code)
+	ts := []struct {
+		name  string
+		token string
+		code  int
+	}{
+		{name: "valid", token: valid, code: http.StatusOK},
+		{name: "valid again", token: valid, code: http.StatusOK},
+		{name: "expired", token: expired, code: http.StatusUnauthorized},
+		{name: "wrong audience", token: wrongAudience, code: http.StatusUnauthorized},
+		{name: "other issuer", token: otherIssuer, code: http.StatusUnauthorized},
+		{name: "forged signature", token: forged, code: http.StatusUnauthorized},
+	}
+	for _, tc := range ts {
+		t.Run(tc.name, func(t *testing.T) {
+			request := httptest.NewRequest("GET", PREFIX+"/jwt.html", nil)
+			request.Header.Add("x-request-id", "request-id-from-header")
+			request.Header.Add("Authorization", "Bearer "+tc.token)
+			responseRecorder := httptest.NewRecorder()
+
+			srv.GetMainHandler().ServeHTTP(responseRecorder, request)
+			if responseRecorder.Code != tc.code {
+				t.Errorf("JWTController returned code %d. Expected %d", responseRecorder.Code, tc.code)
+			}
+		})
+	}
+	if issuer.JWKSFetches() != 1 {
+		t.Errorf("expected the JWKS to be fetched once but was fetched %d times", issuer.JWKSFetches())
 	}
 }
 
@@ -149,3 +201,2587 @@ func TestLogLevelController(t *testing.T) {
 		t.Errorf("LogLevelController returned code %d. Expected 200", responseRecorder.Code)
 	}
 }
+
+type lifecycleProvider struct {
+	events  *[]string
+	started chan struct{}
+}
+
+func (l lifecycleProvider) OnStart(ctx context.Context) error {
+	*l.events = append(*l.events, "provider started")
+	return nil
+}
+
+func (l lifecycleProvider) OnStop(ctx context.Context) error {
+	*l.events = append(*l.events, "provider stopped")
+	return nil
+}
+
+func (l lifecycleProvider) GetControllers() []server.Controller {
+	return []server.Controller{
+		{
+			Name:    "SlowController",
+			Metric:  "SlowController",
+			Methods: []string{"GET"},
+			Path:    "/slow",
+			ControllerFunc: func(ctx *server.Context) {
+				close(l.started)
+				time.Sleep(200 * time.Millisecond)
+				ctx.SendHTMLResponse(http.StatusOK, []byte("done"))
+			},
+		},
+	}
+}
+
+type lifecycleService struct {
+	events *[]string
+}
+
+func (l *lifecycleService) OnStart(ctx context.Context) error {
+	*l.events = append(*l.events, "service started")
+	return nil
+}
+
+func (l *lifecycleService) OnStop(ctx context.Context) error {
+	*l.events = append(*l.events, "service stopped")
+	return nil
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	config := server.CreateConfig("./", "minimal", ConfigProperties)
+	config.SetProperty(server.ConfigEnablePrometheus, "false")
+
+	events := []string{}
+	prov := lifecycleProvider{events: &events, started: make(chan struct{})}
+	srv := server.CreateServer(config, []server.ControllerProvider{prov})
+	srv.RegisterService("lifecycle", &lifecycleService{events: &events})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(context.Background(), l)
+	}()
+
+	type result struct {
+		code int
+		err  error
+	}
+	responses := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(fmt.Sprintf("http://%s/slow", l.Addr()))
+		if err != nil {
+			responses <- result{err: err}
+			return
+		}
+		resp.Body.Close()
+		responses <- result{code: resp.StatusCode}
+	}()
+
+	<-prov.started
+	err = srv.Shutdown(context.Background())
+	if err != nil {
+		t.Errorf("shutdown returned error: %s", err)
+	}
+
+	res := <-responses
+	if res.err != nil || res.code != http.StatusOK {
+		t.Errorf("in-flight request wasn't drained. code: %d, error: %v", res.code, res.err)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("serve returned error: %s", err)
+	}
+
+	expected := []string{"service started", "provider started", "provider stopped", "service stopped"}
+	if !slices.Equal(events, expected) {
+		t.Errorf("unexpected lifecycle events: %+v. Expected %+v", events, expected)
+	}
+}
+
+func TestRunStopsOnContextCancel(t *testing.T) {
+	config := server.CreateConfig("./", "minimal", ConfigProperties)
+	config.SetProperty(server.ConfigEnablePrometheus, "false")
+	config.SetProperty(server.ConfigPort, "0")
+	srv := server.CreateServer(config, []server.ControllerProvider{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Run(ctx)
+	}()
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("run returned error: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("server didn't stop after context was cancelled")
+	}
+}
+
+type middlewareProvider struct{}
+
+func (m middlewareProvider) GetControllers() []server.Controller {
+	return []server.Controller{
+		{
+			Name:    "MiddlewareController",
+			Metric:  "MiddlewareController",
+			Methods: []string{"GET"},
+			Path:    "/middleware",
+			ControllerFunc: func(ctx *server.Context) {
+				ctx.SendHTMLResponse(http.StatusCreated, []byte("created"))
+			},
+			Middlewares: []server.Middleware{
+				func(ctx *server.Context, next func(ctx *server.Context)) {
+					if ctx.Request.FormValue("block") != "" {
+						ctx.SendJsonError(server.JSONErrorResponse{
+							Code:       http.StatusForbidden,
+							Message:    "blocked",
+							LogMessage: "blocked by middleware",
+						})
+						return
+					}
+					next(ctx)
+				},
+			},
+		},
+	}
+}
+
+func TestMiddlewares(t *testing.T) {
+	config := server.CreateConfig("./", "minimal", ConfigProperties)
+	config.SetProperty(server.ConfigEnablePrometheus, "false")
+	srv := server.CreateServer(config, []server.ControllerProvider{middlewareProvider{}})
+
+	order := []string{}
+	observedCode := 0
+	srv.Use(
+		func(ctx *server.Context, next func(ctx *server.Context)) {
+			order = append(order, "first")
+			ctx.SendResponseHeader("X-Middleware", "applied")
+			next(ctx)
+			observedCode = ctx.ResponseCode
+		},
+		func(ctx *server.Context, next func(ctx *server.Context)) {
+			order = append(order, "second")
+			next(ctx)
+		},
+	)
+
+	ts := []struct {
+		name  string
+		query string
+		code  int
+		order []string
+	}{
+		{name: "passing", query: "", code: http.StatusCreated, order: []string{"first", "second"}},
+		{name: "short-circuit", query: "?block=true", code: http.StatusForbidden, order: []string{"first", "second"}},
+	}
+
+	for _, tc := range ts {
+		t.Run(tc.name, func(t *testing.T) {
+			order = []string{}
+			request := httptest.NewRequest("GET", "/middleware"+tc.query, nil)
+			responseRecorder := httptest.NewRecorder()
+
+			srv.GetMainHandler().ServeHTTP(responseRecorder, request)
+
+			if responseRecorder.Code != tc.code {
+				t.Errorf("returned code %d. Expected %d", responseRecorder.Code, tc.code)
+			}
+			if observedCode != tc.code {
+				t.Errorf("middleware observed code %d. Expected %d", observedCode, tc.code)
+			}
+			if responseRecorder.Header().Get("X-Middleware") != "applied" {
+				t.Error("global middleware header is missing")
+			}
+			if !slices.Equal(order, tc.order) {
+				t.Errorf("unexpected middleware order: %+v", order)
+			}
+		})
+	}
+}
+
+type panicProvider struct{}
+
+func (p panicProvider) GetControllers() []server.Controller {
+	return []server.Controller{
+		{
+			Name:    "PanicController",
+			Metric:  "PanicController",
+			Methods: []string{"GET"},
+			Path:    "/panic",
+			ControllerFunc: func(ctx *server.Context) {
+				if ctx.Request.FormValue("sent") != "" {
+					ctx.SendHTMLResponse(http.StatusOK, []byte("sent before panic"))
+				}
+				panic("controller failed")
+			},
+		},
+		{
+			Name:      "PanicAuthController",
+			Metric:    "PanicAuthController",
+			Methods:   []string{"GET"},
+			Path:      "/panic-auth",
+			IsSecured: true,
+			AuthFunc: func(ctx *server.Context) error {
+				var m map[string]string
+				m["boom"] = "nil map"
+				return nil
+			},
+			ControllerFunc: func(ctx *server.Context) {
+				ctx.SendHTMLResponse(http.StatusOK, []byte("unreachable"))
+			},
+		},
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	config := server.CreateConfig("./", "minimal", ConfigProperties)
+	config.SetProperty(server.ConfigEnablePrometheus, "false")
+	srv := server.CreateServer(config, []server.ControllerProvider{panicProvider{}})
+
+	ts := []struct {
+		name      string
+		uri       string
+		code      int
+		jsonError bool
+	}{
+		{name: "controller", uri: "/panic", code: http.StatusInternalServerError, jsonError: true},
+		{name: "auth", uri: "/panic-auth", code: http.StatusInternalServerError, jsonError: true},
+		{name: "already sent", uri: "/panic?sent=true", code: http.StatusOK, jsonError: false},
+	}
+
+	for _, tc := range ts {
+		t.Run(tc.name, func(t *testing.T) {
+			request := httptest.NewRequest("GET", tc.uri, nil)
+			request.Header.Add("X-Request-ID", "panic-"+tc.name)
+			responseRecorder := httptest.NewRecorder()
+
+			srv.GetMainHandler().ServeHTTP(responseRecorder, request)
+
+			if responseRecorder.Code != tc.code {
+				t.Errorf("returned code %d. Expected %d", responseRecorder.Code, tc.code)
+			}
+			if !tc.jsonError {
+				return
+			}
+			jerr := server.JSONErrorResponse{}
+			err := json.Unmarshal(responseRecorder.Body.Bytes(), &jerr)
+			if err != nil {
+				t.Fatalf("response isn't a json error: %s", responseRecorder.Body.String())
+			}
+			if jerr.RequestID != "panic-"+tc.name {
+				t.Errorf("unexpected request id in response: %s", jerr.RequestID)
+			}
+		})
+	}
+
+	stats := srv.InitNonRequestContext().StatusInformation.Stats
+	if stats[server.MetricPanics] != len(ts) {
+		t.Errorf("panic metric is %d. Expected %d", stats[server.MetricPanics], len(ts))
+	}
+}
+
+func TestStructuredLogging(t *testing.T) {
+	config := server.CreateConfig("./", "minimal", ConfigProperties)
+	config.SetProperty(server.ConfigEnablePrometheus, "false")
+	config.SetProperty(server.ConfigLogLevel, "debug")
+	srv := initServer(config)
+	buf := bytes.Buffer{}
+	srv.SetLogHandler(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	request := httptest.NewRequest("GET", PREFIX+"/index.html?fail=true", nil)
+	request.Header.Add("X-Request-ID", "structured-logging")
+	responseRecorder := httptest.NewRecorder()
+	srv.GetMainHandler().ServeHTTP(responseRecorder, request)
+
+	found := map[string]map[string]any{}
+	for _, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+		entry := map[string]any{}
+		err := json.Unmarshal(line, &entry)
+		if err != nil {
+			t.Fatalf("log line isn't valid json: %s", line)
+		}
+		found[entry["msg"].(string)] = entry
+	}
+
+	errEntry, ok := found["Received fail param!"]
+	if !ok {
+		t.Fatalf("error message wasn't logged: %s", buf.String())
+	}
+	expected := map[string]any{
+		"level":      "ERROR",
+		"request_id": "structured-logging",
+		"controller": "Index",
+		"method":     "GET",
+		"route":      PREFIX + "/index.html",
+	}
+	for k, v := range expected {
+		if errEntry[k] != v {
+			t.Errorf("unexpected value of %s: %v. Expected %v", k, errEntry[k], v)
+		}
+	}
+
+	doneEntry, ok := found["Request processed"]
+	if !ok {
+		t.Fatalf("request processed message wasn't logged: %s", buf.String())
+	}
+	if doneEntry["status"] != float64(http.StatusBadRequest) {
+		t.Errorf("unexpected status: %v", doneEntry["status"])
+	}
+	if _, ok := doneEntry["duration"]; !ok {
+		t.Error("duration is missing")
+	}
+}
+
+func TestLogLevelAdmin(t *testing.T) {
+	config := server.CreateConfig("./", "minimal", ConfigProperties)
+	config.SetProperty(server.ConfigEnablePrometheus, "false")
+	config.SetProperty(server.ConfigLogLevel, "info")
+	srv := initServer(config)
+	buf := bytes.Buffer{}
+	srv.SetLogHandler(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: server.LevelTrace}))
+
+	callLogController := func() string {
+		buf.Reset()
+		request := httptest.NewRequest("GET", PREFIX+"/loglevel", nil)
+		srv.GetMainHandler().ServeHTTP(httptest.NewRecorder(), request)
+		return buf.String()
+	}
+	changeLevel := func(query string, body string) int {
+		request := httptest.NewRequest("PUT", PREFIX+"/admin/loglevel"+query, strings.NewReader(body))
+		responseRecorder := httptest.NewRecorder()
+		srv.GetMainHandler().ServeHTTP(responseRecorder, request)
+		return responseRecorder.Code
+	}
+
+	if strings.Contains(callLogController(), "This is a debug message") {
+		t.Error("debug message logged with level info")
+	}
+
+	code := changeLevel("", `{"controller": "LogLevelController", "level": "debug"}`)
+	if code != http.StatusUnauthorized {
+		t.Errorf("unauthenticated change returned code %d. Expected %d", code, http.StatusUnauthorized)
+	}
+
+	code = changeLevel("?secure=true", `{"controller": "LogLevelController", "level": "debug"}`)
+	if code != http.StatusOK {
+		t.Errorf("changing the level returned code %d. Expected 200", code)
+	}
+	if !strings.Contains(callLogController(), "This is a debug message") {
+		t.Error("debug message not logged after changing the controller level to debug")
+	}
+
+	code = changeLevel("?secure=true", `{"level": "error"}`)
+	if code != http.StatusOK {
+		t.Errorf("changing the level returned code %d. Expected 200", code)
+	}
+	if !strings.Contains(callLogController(), "This is a debug message") {
+		t.Error("controller override didn't take precedence over the default level")
+	}
+
+	code = changeLevel("?secure=true", `{"controller": "LogLevelController", "level": ""}`)
+	if code != http.StatusOK {
+		t.Errorf("removing the override returned code %d. Expected 200", code)
+	}
+	logged := callLogController()
+	if strings.Contains(logged, "This is an info message") || !strings.Contains(logged, "This is an error message") {
+		t.Errorf("default level error not applied: %s", logged)
+	}
+
+	code = changeLevel("?secure=true", `{"level": "verbose"}`)
+	if code != http.StatusBadRequest {
+		t.Errorf("invalid level returned code %d. Expected %d", code, http.StatusBadRequest)
+	}
+
+	code = changeLevel("?secure=true", `{"controller": "LogLevelControler", "level": "debug"}`)
+	if code != http.StatusBadRequest {
+		t.Errorf("unknown controller returned code %d. Expected %d", code, http.StatusBadRequest)
+	}
+	if overrides := srv.GetControllerLogLevels(); len(overrides) != 0 {
+		t.Errorf("unknown controller was added to the overrides: %v", overrides)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("override of unknown controller in the config was accepted")
+		}
+	}()
+	config.SetProperty(server.ConfigControllerLogLevels, "LogLevelControler:debug")
+	initServer(config)
+}
+
+func TestBind(t *testing.T) {
+	ts := []struct {
+		name    string
+		uri     string
+		body    string
+		header  string
+		code    int
+		result  string
+		invalid []string
+	}{
+		{name: "success", uri: "/greeting/en?times=2", body: `{"name": "Joe"}`, code: 200, result: "Hello Joe! Hello Joe! "},
+		{name: "header", uri: "/greeting/de", body: `{"name": "Joe"}`, header: "Servus", code: 200, result: "Servus Joe! "},
+		{name: "missing name", uri: "/greeting/en", body: `{}`, code: http.StatusBadRequest, invalid: []string{"name"}},
+		{name: "invalid values", uri: "/greeting/fr?times=5", body: `{"name": "J"}`, header: "G'day", code: http.StatusBadRequest, invalid: []string{"lang", "name", "times", "X-Greeting"}},
+		{name: "zero times", uri: "/greeting/en?times=0", body: `{"name": "Joe"}`, code: http.StatusBadRequest, invalid: []string{"times"}},
+		{name: "unparsable query", uri: "/greeting/en?times=many", body: `{"name": "Joe"}`, code: http.StatusBadRequest, invalid: []string{"times"}},
+		{name: "invalid json", uri: "/greeting/en", body: `{"name": `, code: http.StatusBadRequest, invalid: []string{"body"}},
+	}
+
+	for _, tc := range ts {
+		t.Run(tc.name, func(t *testing.T) {
+			request := httptest.NewRequest("POST", PREFIX+tc.uri, strings.NewReader(tc.body))
+			if tc.header != "" {
+				request.Header.Add("X-Greeting", tc.header)
+			}
+			responseRecorder := httptest.NewRecorder()
+
+			serv.GetMainHandler().ServeHTTP(responseRecorder, request)
+
+			if responseRecorder.Code != tc.code {
+				t.Fatalf("returned code %d. Expected %d: %s", responseRecorder.Code, tc.code, responseRecorder.Body.String())
+			}
+			if tc.code == http.StatusOK {
+				if responseRecorder.Body.String() != tc.result {
+					t.Errorf("unexpected result: %s", responseRecorder.Body.String())
+				}
+				return
+			}
+			jerr := struct {
+				Details []server.FieldError `json:"details"`
+			}{}
+			err := json.Unmarshal(responseRecorder.Body.Bytes(), &jerr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			invalid := []string{}
+			for _, fe := range jerr.Details {
+				invalid = append(invalid, fe.Field)
+			}
+			slices.Sort(invalid)
+			expected := slices.Clone(tc.invalid)
+			slices.Sort(expected)
+			if !slices.Equal(invalid, expected) {
+				t.Errorf("unexpected invalid fields: %+v. Expected: %+v", jerr.Details, tc.invalid)
+			}
+		})
+	}
+}
+
+type bindProvider struct{}
+
+type eventsRequest struct {
+	IDs   []uuid.UUID `query:"id" validate:"max=2"`
+	Since []time.Time `query:"since"`
+}
+
+func (b bindProvider) GetControllers() []server.Controller {
+	return []server.Controller{
+		{
+			Name:    "Events",
+			Metric:  "Events",
+			Methods: []string{"GET"},
+			Path:    "/events",
+			ControllerFunc: func(ctx *server.Context) {
+				req, err := server.Bind[eventsRequest](ctx)
+				if err != nil {
+					ctx.SendJsonError(err)
+					return
+				}
+				ctx.SendHTMLResponse(http.StatusOK, []byte(fmt.Sprintf("%s %s", req.IDs[1], req.Since[0].Format(time.DateOnly))))
+			},
+		},
+	}
+}
+
+func TestBindTextUnmarshalerSlices(t *testing.T) {
+	config := server.CreateConfig("./", "minimal", ConfigProperties)
+	srv := server.CreateServer(config, []server.ControllerProvider{bindProvider{}})
+	id := uuid.NewString()
+	request := httptest.NewRequest("GET", "/events?id="+uuid.NewString()+"&id="+id+"&since=2024-05-01T00:00:00Z", nil)
+	responseRecorder := httptest.NewRecorder()
+	srv.GetMainHandler().ServeHTTP(responseRecorder, request)
+	if responseRecorder.Code != http.StatusOK || responseRecorder.Body.String() != id+" 2024-05-01" {
+		t.Errorf("unexpected response %d: %s", responseRecorder.Code, responseRecorder.Body.String())
+	}
+
+	request = httptest.NewRequest("GET", "/events?id=nope", nil)
+	responseRecorder = httptest.NewRecorder()
+	srv.GetMainHandler().ServeHTTP(responseRecorder, request)
+	if responseRecorder.Code != http.StatusBadRequest {
+		t.Errorf("invalid uuid returned code %d. Expected %d", responseRecorder.Code, http.StatusBadRequest)
+	}
+}
+
+func TestValidateMalformedTags(t *testing.T) {
+	for name, v := range map[string]any{
+		"bad limit": &struct {
+			Name string `validate:"min=two"`
+		}{Name: "x"},
+		"unknown rule": &struct {
+			Name string `validate:"required,email"`
+		}{Name: "x"},
+		"bad regex": &struct {
+			Name string `validate:"regex=^([a-z]+$"`
+		}{Name: "x"},
+		"nested": &struct {
+			Inner struct {
+				Count int `validate:"max=ten"`
+			}
+		}{},
+	} {
+		err := server.Validate(v)
+		var jerr server.JSONErrorResponse
+		if err == nil || errors.As(err, &jerr) {
+			t.Errorf("%s: expected an error other than a 400 but got %v", name, err)
+		}
+	}
+}
+
+func TestPathParams(t *testing.T) {
+	ts := []struct {
+		name   string
+		uri    string
+		code   int
+		result string
+	}{
+		{name: "valid", uri: "/users/42", code: http.StatusOK, result: "User 42"},
+		{name: "invalid", uri: "/users/joe", code: http.StatusBadRequest},
+	}
+
+	for _, tc := range ts {
+		t.Run(tc.name, func(t *testing.T) {
+			request := httptest.NewRequest("GET", PREFIX+tc.uri, nil)
+			responseRecorder := httptest.NewRecorder()
+
+			serv.GetMainHandler().ServeHTTP(responseRecorder, request)
+
+			if responseRecorder.Code != tc.code {
+				t.Errorf("returned code %d. Expected %d", responseRecorder.Code, tc.code)
+			}
+			if tc.result != "" && responseRecorder.Body.String() != tc.result {
+				t.Errorf("unexpected result: %s", responseRecorder.Body.String())
+			}
+		})
+	}
+}
+
+func TestRouteInLogs(t *testing.T) {
+	config := server.CreateConfig("./", "minimal", ConfigProperties)
+	config.SetProperty(server.ConfigEnablePrometheus, "false")
+	srv := initServer(config)
+	buf := bytes.Buffer{}
+	srv.SetLogHandler(slog.NewJSONHandler(&buf, nil))
+
+	request := httptest.NewRequest("GET", PREFIX+"/users/joe", nil)
+	srv.GetMainHandler().ServeHTTP(httptest.NewRecorder(), request)
+
+	entry := map[string]any{}
+	err := json.Unmarshal(bytes.Split(buf.Bytes(), []byte("\n"))[0], &entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry["route"] != PREFIX+"/users/{id}" {
+		t.Errorf("unexpected route: %v", entry["route"])
+	}
+}
+
+type greeter interface {
+	greet(name string) string
+}
+
+type lazyGreeter struct {
+	hello *helloService
+}
+
+func (l *lazyGreeter) greet(name string) string {
+	return l.hello.sayHello(name)
+}
+
+func TestServiceRegistry(t *testing.T) {
+	config := server.CreateConfig("./", "minimal", ConfigProperties)
+	config.SetProperty(server.ConfigEnablePrometheus, "false")
+	srv := server.CreateServer(config, []server.ControllerProvider{})
+	ctx := srv.InitNonRequestContext()
+
+	_, err := server.Resolve[*helloService](ctx)
+	if !errors.Is(err, server.ErrServiceNotFound) {
+		t.Errorf("expected ErrServiceNotFound but got: %v", err)
+	}
+	if srv.GetService("hello") != nil {
+		t.Error("expected nil for unknown named service")
+	}
+
+	constructed := 0
+	server.ProvideLazy[greeter](srv, func(s *server.Server) (greeter, error) {
+		constructed++
+		hello, err := server.ResolveFromServer[*helloService](s)
+		if err != nil {
+			return nil, err
+		}
+		return &lazyGreeter{hello: hello}, nil
+	}, server.DependsOn[*helloService]())
+
+	err = srv.ValidateServices()
+	if !errors.Is(err, server.ErrServiceNotFound) {
+		t.Errorf("expected missing dependency to be reported but got: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = srv.Serve(context.Background(), l)
+	if !errors.Is(err, server.ErrServiceNotFound) {
+		t.Errorf("expected server start to fail because of missing dependency but got: %v", err)
+	}
+
+	server.Provide(srv, &helloService{})
+	err = srv.ValidateServices()
+	if err != nil {
+		t.Errorf("unexpected validation error: %s", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		g, err := server.Resolve[greeter](ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if g.greet("Joe") != "Hello Joe" {
+			t.Errorf("unexpected greeting: %s", g.greet("Joe"))
+		}
+	}
+	if constructed != 1 {
+		t.Errorf("lazy service constructed %d times", constructed)
+	}
+}
+
+func TestStatusControllerJSON(t *testing.T) {
+	serv.InitNonRequestContext().StatusInformation.SetMetric("Other Metric", 7)
+
+	ts := []struct {
+		name   string
+		accept string
+		json   bool
+	}{
+		{name: "json", accept: "application/json", json: true},
+		{name: "browser", accept: "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", json: false},
+		{name: "quality", accept: "text/html;q=0.5, application/json", json: true},
+		{name: "none", accept: "", json: false},
+	}
+
+	for _, tc := range ts {
+		t.Run(tc.name, func(t *testing.T) {
+			request := httptest.NewRequest("GET", PREFIX+"/status", nil)
+			request.Header.Add("Accept", tc.accept)
+			responseRecorder := httptest.NewRecorder()
+
+			serv.GetMainHandler().ServeHTTP(responseRecorder, request)
+
+			if responseRecorder.Code != 200 {
+				t.Fatalf("StatusController returned code %d. Expected 200", responseRecorder.Code)
+			}
+			if !tc.json {
+				if !strings.HasPrefix(responseRecorder.Body.String(), "<html>") {
+					t.Errorf("expected html but got: %s", responseRecorder.Body.String())
+				}
+				return
+			}
+			status := server.StatusResponse{}
+			err := json.Unmarshal(responseRecorder.Body.Bytes(), &status)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status.Build.GoVersion == "" {
+				t.Error("go version is missing")
+			}
+			if status.Metrics["Other Metric"] != 7 {
+				t.Errorf("unexpected metrics: %+v", status.Metrics)
+			}
+			found := false
+			for _, ctr := range status.Controllers {
+				if ctr.Name == "Index" && ctr.Path == "/index.html" && slices.Equal(ctr.Methods, []string{"GET"}) {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("index controller is missing: %+v", status.Controllers)
+			}
+		})
+	}
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	config := server.CreateConfig("./", "minimal", ConfigProperties)
+	config.SetProperty(server.ConfigEnablePrometheus, "false")
+	config.SetProperty(server.ConfigHealthCheckTimeout, "50ms")
+	srv := initServer(config)
+
+	var downstreamErr error
+	srv.RegisterHealthCheck("downstream", server.HealthCheckFunc(func(ctx context.Context) error {
+		return downstreamErr
+	}))
+
+	call := func(path string) (int, server.HealthResponse) {
+		request := httptest.NewRequest("GET", PREFIX+path, nil)
+		responseRecorder := httptest.NewRecorder()
+		srv.GetMainHandler().ServeHTTP(responseRecorder, request)
+		response := server.HealthResponse{}
+		err := json.Unmarshal(responseRecorder.Body.Bytes(), &response)
+		if err != nil {
+			t.Fatalf("invalid health response: %s", responseRecorder.Body.String())
+		}
+		return responseRecorder.Code, response
+	}
+
+	code, response := call("/readyz")
+	if code != http.StatusOK || response.Checks["downstream"].Status != server.HealthStatusOK {
+		t.Errorf("expected ready but got %d: %+v", code, response)
+	}
+
+	downstreamErr = errors.New("connection refused")
+	code, response = call("/readyz")
+	if code != http.StatusServiceUnavailable || response.Checks["downstream"].Error != "connection refused" {
+		t.Errorf("expected not ready but got %d: %+v", code, response)
+	}
+
+	downstreamErr = nil
+	srv.RegisterHealthCheck("hanging", server.HealthCheckFunc(func(ctx context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	}))
+	code, response = call("/readyz")
+	if code != http.StatusServiceUnavailable || response.Checks["hanging"].Status != server.HealthStatusFailed {
+		t.Errorf("expected timeout but got %d: %+v", code, response)
+	}
+
+	srv.SetRepository(nil)
+	srv.RegisterHealthCheck("panicking", server.HealthCheckFunc(func(ctx context.Context) error {
+		panic("nil client")
+	}))
+	code, response = call("/readyz")
+	if code != http.StatusServiceUnavailable || !strings.Contains(response.Checks["panicking"].Error, "nil client") {
+		t.Errorf("expected a failed check but got %d: %+v", code, response)
+	}
+	if _, ok := response.Checks["repository"]; ok {
+		t.Errorf("nil repository was registered: %+v", response)
+	}
+
+	code, response = call("/healthz")
+	if code != http.StatusOK || response.Status != server.HealthStatusOK {
+		t.Errorf("expected alive but got %d: %+v", code, response)
+	}
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	// every server has its own registry, so several of them can coexist
+	srv := initServer(server.CreateConfig("./", "minimal", ConfigProperties))
+	other := initServer(server.CreateConfig("./", "minimal", ConfigProperties))
+	if srv.MetricsRegistry() == nil || srv.MetricsRegistry() == other.MetricsRegistry() {
+		t.Fatal("expected separate metrics registries")
+	}
+
+	for _, uri := range []string{"/index.html", "/index.html?fail=true", "/secured.html"} {
+		request := httptest.NewRequest("GET", PREFIX+uri, nil)
+		srv.GetMainHandler().ServeHTTP(httptest.NewRecorder(), request)
+	}
+	srv.InitNonRequestContext().StatusInformation.SetMetric("Other Metric", 3)
+
+	request := httptest.NewRequest("GET", PREFIX+"/metrics", nil)
+	responseRecorder := httptest.NewRecorder()
+	srv.GetMainHandler().ServeHTTP(responseRecorder, request)
+	body := responseRecorder.Body.String()
+
+	expected := []string{
+		`ssf_server_controller_requestcount_count{code="200",controller="Index",method="GET",route="/min/index.html",tenant=""} 1`,
+		`ssf_server_controller_requestcount_count{code="400",controller="Index",method="GET",route="/min/index.html",tenant=""} 1`,
+		`ssf_server_auth_failures_total{controller="SecuredControlller",reason="unauthenticated"} 1`,
+		`ssf_server_response_size_bytes_count{controller="Index"} 2`,
+		`ssf_server_requests_in_flight 0`,
+		`ssf_server_status_metric{metric="IndexCtrl"} 2`,
+		`ssf_server_status_metric{metric="Other Metric"} 3`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(body, e) {
+			t.Errorf("metric missing: %s", e)
+		}
+	}
+}
+
+type tracedEntity struct {
+	ID   int
+	Name string
+}
+
+func TestTracing(t *testing.T) {
+	srv := initServer(server.CreateConfig("./", "minimal", ConfigProperties))
+	exporter := tracetest.NewInMemoryExporter()
+	srv.EnableTracing(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+
+	// dry run: gorm builds the statements and runs the callbacks without a DB
+	db, err := gorm.Open(mysql.New(mysql.Config{DSN: "user:pw@tcp(localhost:3306)/test", SkipInitializeWithVersion: true}), &gorm.Config{DryRun: true, DisableAutomaticPing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.SetRepository(&server.Repository{DB: db})
+
+	var traceID, parentID string
+	srv.Use(func(ctx *server.Context, next func(ctx *server.Context)) {
+		sc := ctx.Span().SpanContext()
+		traceID, parentID = sc.TraceID().String(), sc.SpanID().String()
+		entities := []tracedEntity{}
+		ctx.Repository.WithContext(ctx.TraceContext()).Find(&entities)
+		next(ctx)
+	})
+
+	request := httptest.NewRequest("GET", PREFIX+"/users/42", nil)
+	request.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	srv.GetMainHandler().ServeHTTP(httptest.NewRecorder(), request)
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("expected a gorm and a controller span but got %d", len(spans))
+	}
+	gormSpan, ctrSpan := spans[0], spans[1]
+	if ctrSpan.Name != "GET /min/users/{id}" || ctrSpan.SpanKind != trace.SpanKindServer {
+		t.Errorf("unexpected controller span: %s (%s)", ctrSpan.Name, ctrSpan.SpanKind)
+	}
+	if traceID != "4bf92f3577b34da6a3ce929d0e0e4736" || ctrSpan.SpanContext.TraceID().String() != traceID {
+		t.Errorf("trace of the caller not continued: %s", traceID)
+	}
+	if ctrSpan.Parent.SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("unexpected parent of controller span: %s", ctrSpan.Parent.SpanID())
+	}
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, a := range ctrSpan.Attributes {
+		attrs[a.Key] = a.Value
+	}
+	if attrs["ssf.controller"].AsString() != "UserController" || attrs["http.response.status_code"].AsInt64() != 200 {
+		t.Errorf("unexpected controller span attributes: %+v", ctrSpan.Attributes)
+	}
+
+	if gormSpan.Name != "gorm.query" || gormSpan.Parent.SpanID().String() != parentID {
+		t.Errorf("unexpected gorm span: %s, parent: %s", gormSpan.Name, gormSpan.Parent.SpanID())
+	}
+	for _, a := range gormSpan.Attributes {
+		if a.Key == "db.query.text" && !strings.Contains(a.Value.AsString(), "SELECT * FROM `traced_entities`") {
+			t.Errorf("unexpected query: %s", a.Value.AsString())
+		}
+	}
+}
+
+func TestRequestIDPropagation(t *testing.T) {
+	srv := initServer(server.CreateConfig("./", "minimal", ConfigProperties))
+	exporter := tracetest.NewInMemoryExporter()
+	srv.EnableTracing(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+
+	var forwarded http.Header
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Clone()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer downstream.Close()
+
+	var traceID string
+	srv.Use(func(ctx *server.Context, next func(ctx *server.Context)) {
+		traceID = ctx.Span().SpanContext().TraceID().String()
+		resp, err := ctx.HTTPClient().Get(downstream.URL + "/downstream")
+		if err != nil {
+			t.Errorf("outbound call failed: %s", err)
+		} else {
+			resp.Body.Close()
+		}
+		next(ctx)
+	})
+
+	request := httptest.NewRequest("GET", PREFIX+"/index.html", nil)
+	request.Header.Set(server.HeaderRequestID, "propagated-id")
+	responseRecorder := httptest.NewRecorder()
+	srv.GetMainHandler().ServeHTTP(responseRecorder, request)
+
+	if id := responseRecorder.Header().Get(server.HeaderRequestID); id != "propagated-id" {
+		t.Errorf("request id not set on response: '%s'", id)
+	}
+	if id := forwarded.Get(server.HeaderRequestID); id != "propagated-id" {
+		t.Errorf("request id not forwarded: '%s'", id)
+	}
+	if tp := forwarded.Get("traceparent"); !strings.Contains(tp, traceID) {
+		t.Errorf("trace not forwarded. traceparent: '%s', expected trace id: %s", tp, traceID)
+	}
+
+	// a generated request id is sent back as well
+	responseRecorder = httptest.NewRecorder()
+	serv.GetMainHandler().ServeHTTP(responseRecorder, httptest.NewRequest("GET", PREFIX+"/index.html", nil))
+	if responseRecorder.Header().Get(server.HeaderRequestID) == "" {
+		t.Error("generated request id not set on response")
+	}
+
+	// so are responses of the router and error responses
+	for _, r := range []struct {
+		method string
+		path   string
+		code   int
+	}{
+		{method: "GET", path: PREFIX + "/unknown", code: http.StatusNotFound},
+		{method: "GET", path: PREFIX + "/secured.html", code: http.StatusUnauthorized},
+	} {
+		responseRecorder = httptest.NewRecorder()
+		serv.GetMainHandler().ServeHTTP(responseRecorder, httptest.NewRequest(r.method, r.path, nil))
+		id := responseRecorder.Header().Get(server.HeaderRequestID)
+		if responseRecorder.Code != r.code || id == "" {
+			t.Errorf("%s %s: expected %d with request id but got %d and '%s'", r.method, r.path, r.code, responseRecorder.Code, id)
+		}
+		jerr := server.JSONErrorResponse{}
+		if json.Unmarshal(responseRecorder.Body.Bytes(), &jerr) == nil && jerr.RequestID != id {
+			t.Errorf("%s %s: request id of response body '%s' differs from header '%s'", r.method, r.path, jerr.RequestID, id)
+		}
+	}
+
+	responseRecorder = httptest.NewRecorder()
+	srv.GetMainHandler().ServeHTTP(responseRecorder, httptest.NewRequest("GET", PREFIX+"/metrics", nil))
+	host := strings.TrimPrefix(downstream.URL, "http://")
+	expected := fmt.Sprintf(`ssf_server_outbound_request_duration_ms_count{code="204",controller="Index",host="%s",method="GET"} 1`, host)
+	if !strings.Contains(responseRecorder.Body.String(), expected) {
+		t.Errorf("outbound metric missing: %s", expected)
+	}
+}
+
+func TestAuthFuncs(t *testing.T) {
+	ts := []struct {
+		name   string
+		header string
+		value  string
+		code   int
+	}{
+		{name: "api key", header: "X-API-Key", value: "minimal-api-key", code: http.StatusOK},
+		{name: "wrong api key", header: "X-API-Key", value: "wrong", code: http.StatusUnauthorized},
+		{name: "basic auth", header: "Authorization", value: "Basic YWRtaW46YWRtaW4tcGFzc3dvcmQ=", code: http.StatusOK},
+		{name: "wrong password", header: "Authorization", value: "Basic YWRtaW46d3Jvbmc=", code: http.StatusUnauthorized},
+		{name: "no credentials", code: http.StatusUnauthorized},
+	}
+	for _, tc := range ts {
+		t.Run(tc.name, func(t *testing.T) {
+			request := httptest.NewRequest("GET", PREFIX+"/apikey.html", nil)
+			if tc.header != "" {
+				request.Header.Set(tc.header, tc.value)
+			}
+			responseRecorder := httptest.NewRecorder()
+			serv.GetMainHandler().ServeHTTP(responseRecorder, request)
+			if responseRecorder.Code != tc.code {
+				t.Errorf("expected %d but got %d", tc.code, responseRecorder.Code)
+			}
+			if tc.code == http.StatusUnauthorized && responseRecorder.Header().Get("WWW-Authenticate") != `Basic realm="minimal"` {
+				t.Errorf("WWW-Authenticate header missing")
+			}
+		})
+	}
+}
+
+func TestHMACAuth(t *testing.T) {
+	send := func(request *http.Request) *httptest.ResponseRecorder {
+		request.RequestURI = request.URL.RequestURI()
+		responseRecorder := httptest.NewRecorder()
+		serv.GetMainHandler().ServeHTTP(responseRecorder, request)
+		return responseRecorder
+	}
+	newRequest := func(body string, secret string) *http.Request {
+		request, err := http.NewRequest("POST", "http://localhost"+PREFIX+"/signed?x=1", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = server.SignRequest(request, "minimal", secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return request
+	}
+
+	request := newRequest(`{"hello":"world"}`, "minimal-hmac-secret")
+	replay := request.Clone(context.Background())
+	replay.Body = ioutil.NopCloser(strings.NewReader(`{"hello":"world"}`))
+	rr := send(request)
+	if rr.Code != http.StatusOK || rr.Body.String() != `{"hello":"world"}` {
+		t.Errorf("signed request failed: %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := send(replay); rr.Code != http.StatusUnauthorized {
+		t.Errorf("replayed request returned %d", rr.Code)
+	}
+
+	if rr := send(newRequest("{}", "wrong-secret")); rr.Code != http.StatusUnauthorized {
+		t.Errorf("wrong secret returned %d", rr.Code)
+	}
+
+	tampered := newRequest(`{"amount":1}`, "minimal-hmac-secret")
+	tampered.Body = ioutil.NopCloser(strings.NewReader(`{"amount":1000}`))
+	if rr := send(tampered); rr.Code != http.StatusUnauthorized {
+		t.Errorf("tampered body returned %d", rr.Code)
+	}
+
+	expired := newRequest("{}", "minimal-hmac-secret")
+	expired.Header.Set(server.HeaderHMACTimestamp, fmt.Sprint(time.Now().Add(-time.Hour).Unix()))
+	if rr := send(expired); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expired request returned %d", rr.Code)
+	}
+}
+
+func TestMemoryNonceStore(t *testing.T) {
+	store := &server.MemoryNonceStore{}
+	ctx := context.Background()
+	for i, c := range []struct {
+		nonce  string
+		expiry time.Time
+		fresh  bool
+	}{
+		{nonce: "a", expiry: time.Now().Add(time.Minute), fresh: true},
+		{nonce: "a", expiry: time.Now().Add(time.Minute), fresh: false},
+		{nonce: "b", expiry: time.Now().Add(-time.Second), fresh: true},
+		// expired nonces don't count even before they are swept
+		{nonce: "b", expiry: time.Now().Add(time.Minute), fresh: true},
+	} {
+		fresh, err := store.CheckAndStore(ctx, c.nonce, c.expiry)
+		if err != nil || fresh != c.fresh {
+			t.Errorf("%d: nonce %s returned %t, %v. Expected %t", i, c.nonce, fresh, err, c.fresh)
+		}
+	}
+}
+
+type combinedAuthProvider struct{}
+
+func (p combinedAuthProvider) GetControllers() []server.Controller {
+	return []server.Controller{
+		{
+			Name:      "Combined",
+			Metric:    "Combined",
+			Methods:   []string{"GET"},
+			Path:      "/combined",
+			IsSecured: true,
+			AuthFunc: server.AnyOf(
+				server.GetBasicAuth("minimal", server.BasicAuthUsers{}),
+				server.GetAPIKeyAuthFromHeader("X-API-Key", server.StaticAPIKeys{"minimal": "minimal-api-key"}),
+			),
+			ControllerFunc: func(ctx *server.Context) {
+				ctx.SendHTMLResponse(http.StatusOK, []byte("ok"))
+			},
+		},
+	}
+}
+
+func TestAuthCombinators(t *testing.T) {
+	ok := func(ctx *server.Context) error { return nil }
+	fail := func(ctx *server.Context) error { return server.ErrInvalidCredentials }
+	ctx := serv.InitNonRequestContext()
+
+	if err := server.AnyOf(fail, ok)(ctx); err != nil {
+		t.Errorf("AnyOf failed: %s", err)
+	}
+	if err := server.AnyOf(fail, fail)(ctx); !errors.Is(err, server.ErrInvalidCredentials) {
+		t.Errorf("AnyOf succeeded unexpectedly: %v", err)
+	}
+	if err := server.AllOf(ok, ok)(ctx); err != nil {
+		t.Errorf("AllOf failed: %s", err)
+	}
+	if err := server.AllOf(ok, fail)(ctx); !errors.Is(err, server.ErrInvalidCredentials) {
+		t.Errorf("AllOf succeeded unexpectedly: %v", err)
+	}
+
+	// the basic auth challenge is only sent if all auth functions fail
+	srv := server.CreateServer(server.CreateConfig("./", "minimal", ConfigProperties), []server.ControllerProvider{combinedAuthProvider{}})
+	for key, code := range map[string]int{"minimal-api-key": http.StatusOK, "wrong": http.StatusUnauthorized} {
+		request := httptest.NewRequest("GET", "/combined", nil)
+		request.Header.Set("X-API-Key", key)
+		responseRecorder := httptest.NewRecorder()
+		srv.GetMainHandler().ServeHTTP(responseRecorder, request)
+		challenge := responseRecorder.Header().Get("WWW-Authenticate")
+		if responseRecorder.Code != code || (code == http.StatusOK) != (challenge == "") {
+			t.Errorf("unexpected response %d with WWW-Authenticate '%s'", responseRecorder.Code, challenge)
+		}
+	}
+}
+
+func TestPrincipal(t *testing.T) {
+	config := server.CreateConfig("./", "minimal", ConfigProperties)
+	config.SetProperty(server.ConfigEnablePrometheus, "false")
+	config.SetProperty(server.ConfigLogLevel, "debug")
+	srv := initServer(config)
+	buf := bytes.Buffer{}
+	srv.SetLogHandler(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	ts := []struct {
+		name     string
+		header   string
+		value    string
+		expected string
+	}{
+		{name: "api key", header: "X-API-Key", value: "minimal-api-key", expected: "Hello minimal, authenticated with api_key!"},
+		{name: "basic auth", header: "Authorization", value: "Basic YWRtaW46YWRtaW4tcGFzc3dvcmQ=", expected: "Hello admin, authenticated with basic!"},
+	}
+	for _, tc := range ts {
+		t.Run(tc.name, func(t *testing.T) {
+			buf.Reset()
+			request := httptest.NewRequest("GET", PREFIX+"/apikey.html", nil)
+			request.Header.Set(tc.header, tc.value)
+			responseRecorder := httptest.NewRecorder()
+			srv.GetMainHandler().ServeHTTP(responseRecorder, request)
+			if responseRecorder.Body.String() != tc.expected {
+				t.Errorf("unexpected response: %s", responseRecorder.Body.String())
+			}
+
+			subject, _, _ := strings.Cut(strings.TrimPrefix(tc.expected, "Hello "), ",")
+			for _, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+				entry := map[string]any{}
+				json.Unmarshal(line, &entry)
+				if entry["msg"] == "Request processed" && entry["subject"] != subject {
+					t.Errorf("subject missing in log: %s", line)
+				}
+			}
+		})
+	}
+
+	// no principal for unsecured controllers
+	srv.Use(func(ctx *server.Context, next func(ctx *server.Context)) {
+		if ctx.Principal() != nil {
+			t.Errorf("unexpected principal: %+v", ctx.Principal())
+		}
+		next(ctx)
+	})
+	srv.GetMainHandler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", PREFIX+"/index.html", nil))
+}
+
+type authzProvider struct{}
+
+func (p authzProvider) GetControllers() []server.Controller {
+	// the principal gets the scopes and roles listed in the headers
+	authFunc := func(ctx *server.Context) error {
+		if ctx.Request.Header.Get("X-User") == "" {
+			return server.ErrMissingCredentials
+		}
+		ctx.SetPrincipal(&server.Principal{
+			Subject: ctx.Request.Header.Get("X-User"),
+			Scopes:  strings.Fields(ctx.Request.Header.Get("X-Scopes")),
+			Roles:   strings.Fields(ctx.Request.Header.Get("X-Roles")),
+		})
+		return nil
+	}
+	return []server.Controller{
+		{
+			Name:           "AuthzController",
+			Metric:         "AuthzController",
+			Methods:        []string{"GET"},
+			Path:           "/authz",
+			IsSecured:      true,
+			AuthFunc:       authFunc,
+			RequiredScopes: []string{"read", "write"},
+			RequiredRoles:  []string{"admin", "editor"},
+			ControllerFunc: func(ctx *server.Context) {
+				ctx.SendHTMLResponse(http.StatusOK, []byte("authorized"))
+			},
+		},
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	config := server.CreateConfig("./", "minimal", ConfigProperties)
+	srv := server.CreateServer(config, []server.ControllerProvider{authzProvider{}})
+
+	ts := []struct {
+		name   string
+		user   string
+		scopes string
+		roles  string
+		code   int
+	}{
+		{name: "authorized", user: "alice", scopes: "read write", roles: "editor", code: http.StatusOK},
+		{name: "unauthenticated", code: http.StatusUnauthorized},
+		{name: "missing scope", user: "bob", scopes: "read", roles: "admin", code: http.StatusForbidden},
+		{name: "missing role", user: "carol", scopes: "read write", roles: "viewer", code: http.StatusForbidden},
+	}
+	for _, tc := range ts {
+		t.Run(tc.name, func(t *testing.T) {
+			request := httptest.NewRequest("GET", "/authz", nil)
+			request.Header.Set("X-User", tc.user)
+			request.Header.Set("X-Scopes", tc.scopes)
+			request.Header.Set("X-Roles", tc.roles)
+			responseRecorder := httptest.NewRecorder()
+			srv.GetMainHandler().ServeHTTP(responseRecorder, request)
+			if responseRecorder.Code != tc.code {
+				t.Errorf("expected %d but got %d", tc.code, responseRecorder.Code)
+			}
+			if tc.code == http.StatusForbidden && !strings.Contains(responseRecorder.Body.String(), `"message":"forbidden"`) {
+				t.Errorf("unexpected error response: %s", responseRecorder.Body.String())
+			}
+		})
+	}
+
+	responseRecorder := httptest.NewRecorder()
+	srv.GetMainHandler().ServeHTTP(responseRecorder, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(responseRecorder.Body.String(), `ssf_server_auth_failures_total{controller="AuthzController",reason="forbidden"} 2`) {
+		t.Error("forbidden requests not counted")
+	}
+
+	request := httptest.NewRequest("GET", "/status", nil)
+	request.Header.Set("Accept", "application/json")
+	responseRecorder = httptest.NewRecorder()
+	srv.GetMainHandler().ServeHTTP(responseRecorder, request)
+	status := server.StatusResponse{}
+	json.Unmarshal(responseRecorder.Body.Bytes(), &status)
+	for _, ctr := range status.Controllers {
+		if ctr.Name == "AuthzController" && (!ctr.Secured || !slices.Equal(ctr.RequiredScopes, []string{"read", "write"}) || !slices.Equal(ctr.RequiredRoles, []string{"admin", "editor"})) {
+			t.Errorf("requirements missing on status page: %+v", ctr)
+		}
+	}
+	responseRecorder = httptest.NewRecorder()
+	srv.GetMainHandler().ServeHTTP(responseRecorder, httptest.NewRequest("GET", "/status", nil))
+	if !strings.Contains(responseRecorder.Body.String(), "authenticated, scopes: read and write, roles: admin or editor") {
+		t.Error("requirements missing on html status page")
+	}
+}
+
+type jwksProvider struct {
+	issuer string
+}
+
+func (p jwksProvider) GetControllers() []server.Controller {
+	return []server.Controller{
+		{
+			Name:      "JWKSController",
+			Metric:    "JWKSController",
+			Methods:   []string{"GET"},
+			Path:      "/jwks",
+			IsSecured: true,
+			AuthFunc:  server.GetJwtAuth(p.issuer, nil),
+			ControllerFunc: func(ctx *server.Context) {
+				ctx.SendHTMLResponse(http.StatusOK, []byte(ctx.Principal().Subject))
+			},
+		},
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	issuer := servertest.NewIssuer()
+	defer issuer.Close()
+	rsaKey := issuer.Key()
+	psKey, _ := issuer.RotateKey("PS256")
+	ecKey, _ := issuer.RotateKey("ES256")
+	certKey, _ := servertest.NewKey("RS384")
+	certJWK := certKey.JWK()
+	certJWK.N, certJWK.E = "", ""
+	issuer.Publish(certJWK)
+
+	config := server.CreateConfig("./", "minimal", ConfigProperties)
+	config.SetProperty(server.ConfigJWKSMinRefetchInterval, "200ms")
+	srv := server.CreateServer(config, []server.ControllerProvider{jwksProvider{issuer: issuer.URL}})
+	call := func(token string) int {
+		request := httptest.NewRequest("GET", "/jwks", nil)
+		request.Header.Set("Authorization", "Bearer "+token)
+		responseRecorder := httptest.NewRecorder()
+		srv.GetMainHandler().ServeHTTP(responseRecorder, request)
+		return responseRecorder.Code
+	}
+	token := func(key *servertest.Key) string {
+		token, err := issuer.TokenWithKey(key, servertest.Claims{"sub": "user-1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	forge := func(key *servertest.Key, kid string, alg string) *servertest.Key {
+		forged := *key
+		forged.ID, forged.Algorithm = kid, alg
+		return &forged
+	}
+	hs256Token := func() string {
+		header := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"alg":"HS256","typ":"JWT","kid":"%s"}`, rsaKey.ID)))
+		payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"iss":"%s","sub":"user-1"}`, issuer.URL)))
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte(header + "." + payload))
+		return header + "." + payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	}
+
+	ts := []struct {
+		name  string
+		token string
+		code  int
+	}{
+		{name: "RS256", token: token(rsaKey), code: http.StatusOK},
+		{name: "PS256", token: token(psKey), code: http.StatusOK},
+		{name: "ES256", token: token(ecKey), code: http.StatusOK},
+		{name: "x5c", token: token(certKey), code: http.StatusOK},
+		{name: "wrong key", token: token(forge(certKey, rsaKey.ID, "RS256")), code: http.StatusUnauthorized},
+		{name: "algorithm restricted by key", token: token(forge(rsaKey, rsaKey.ID, "RS512")), code: http.StatusUnauthorized},
+		{name: "algorithm not matching key", token: token(forge(ecKey, certKey.ID, "ES256")), code: http.StatusUnauthorized},
+		{name: "HS256", token: hs256Token(), code: http.StatusUnauthorized},
+	}
+	for _, tc := range ts {
+		t.Run(tc.name, func(t *testing.T) {
+			if code := call(tc.token); code != tc.code {
+				t.Errorf("expected %d but got %d", tc.code, code)
+			}
+		})
+	}
+	if issuer.JWKSFetches() != 1 {
+		t.Errorf("expected the JWKS to be fetched once but was fetched %d times", issuer.JWKSFetches())
+	}
+
+	// rotated keys are picked up, but unknown key ids don't flood the identity provider
+	time.Sleep(200 * time.Millisecond)
+	rotatedKey, _ := servertest.NewKey("RS256")
+	for i := 0; i < 5; i++ {
+		if code := call(token(forge(rotatedKey, fmt.Sprintf("unknown-%d", i), "RS256"))); code != http.StatusUnauthorized {
+			t.Errorf("unknown key accepted: %d", code)
+		}
+	}
+	if issuer.JWKSFetches() != 2 {
+		t.Errorf("expected a single refetch but JWKS was fetched %d times", issuer.JWKSFetches())
+	}
+	issuer.Publish(rotatedKey.JWK())
+	time.Sleep(200 * time.Millisecond)
+	if code := call(token(rotatedKey)); code != http.StatusOK {
+		t.Errorf("rotated key not accepted: %d", code)
+	}
+
+	// a client giving up doesn't fail the fetch for everybody else
+	provider := server.NewJWKSProvider(issuer.URL, server.JWKSOptions{})
+	defer provider.Close()
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := provider.GetKey(canceled, rsaKey.ID, "RS256"); err != nil {
+		t.Errorf("fetch of canceled request failed: %s", err)
+	}
+	if _, err := provider.GetKey(context.Background(), psKey.ID, "PS256"); err != nil {
+		t.Errorf("key not available after canceled request: %s", err)
+	}
+}
+
+func TestJWKSURLPerIssuer(t *testing.T) {
+	issuerA, issuerB, keyHost := servertest.NewIssuer(), servertest.NewIssuer(), servertest.NewIssuer()
+	defer issuerA.Close()
+	defer issuerB.Close()
+	defer keyHost.Close()
+
+	config := server.CreateConfig("./", "minimal", ConfigProperties)
+	config.SetProperty(server.ConfigJWKSURL, keyHost.URL+"/.well-known/jwks.json")
+	config.SetProperty(server.ConfigJWKSIssuer, issuerA.URL)
+	srv := server.CreateServer(config, []server.ControllerProvider{jwtOptionsProvider{opts: server.JWTOptions{Issuers: []string{issuerA.URL, issuerB.URL}}}})
+	call := func(token string, err error) int {
+		if err != nil {
+			t.Fatal(err)
+		}
+		request := httptest.NewRequest("GET", "/jwt", nil)
+		request.Header.Set("Authorization", "Bearer "+token)
+		responseRecorder := httptest.NewRecorder()
+		srv.GetMainHandler().ServeHTTP(responseRecorder, request)
+		return responseRecorder.Code
+	}
+	if code := call(issuerA.TokenWithKey(keyHost.Key(), servertest.Claims{"sub": "user-1"})); code != http.StatusOK {
+		t.Errorf("keys of the configured JWKS URL not used: %d", code)
+	}
+	if code := call(issuerB.Token(servertest.Claims{"sub": "user-1"})); code != http.StatusOK {
+		t.Errorf("keys of other issuer not discovered: %d", code)
+	}
+	if code := call(issuerB.TokenWithKey(keyHost.Key(), servertest.Claims{"sub": "user-1"})); code != http.StatusUnauthorized {
+		t.Errorf("configured JWKS URL applied to other issuer: %d", code)
+	}
+	if keyHost.JWKSFetches() != 1 || issuerB.JWKSFetches() != 1 || issuerA.JWKSFetches() != 0 {
+		t.Errorf("unexpected JWKS fetches: %d, %d, %d", keyHost.JWKSFetches(), issuerB.JWKSFetches(), issuerA.JWKSFetches())
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("jwks_url without jwks_issuer was accepted")
+		}
+	}()
+	config = server.CreateConfig("./", "minimal", ConfigProperties)
+	config.SetProperty(server.ConfigJWKSURL, keyHost.URL+"/.well-known/jwks.json")
+	server.CreateServer(config, nil)
+}
+
+type jwtOptionsProvider struct {
+	opts server.JWTOptions
+}
+
+func (p jwtOptionsProvider) GetControllers() []server.Controller {
+	return []server.Controller{
+		{
+			Name:      "JWTOptionsController",
+			Metric:    "JWTOptionsController",
+			Methods:   []string{"GET"},
+			Path:      "/jwt",
+			IsSecured: true,
+			AuthFunc:  server.GetJwtAuthWithOptions(p.opts),
+			ControllerFunc: func(ctx *server.Context) {
+				ctx.SendHTMLResponse(http.StatusOK, []byte(ctx.Principal().Subject))
+			},
+		},
+	}
+}
+
+func TestJWTValidation(t *testing.T) {
+	issuer := servertest.NewIssuer()
+	defer issuer.Close()
+	otherIssuer := servertest.NewIssuer()
+	defer otherIssuer.Close()
+	unknownIssuer := servertest.NewIssuer()
+	defer unknownIssuer.Close()
+
+	config := server.CreateConfig("./", "minimal", ConfigProperties)
+	config.SetProperty(server.ConfigJWTClockSkew, "1m")
+	srv := server.CreateServer(config, []server.ControllerProvider{jwtOptionsProvider{opts: server.JWTOptions{
+		Issuers:   []string{issuer.URL, otherIssuer.URL},
+		Audiences: []string{"api-1", "api-2"},
+		Validator: func(claims server.JWTClaims) error {
+			if claims["sub"] == "blocked" {
+				return errors.New("user is blocked")
+			}
+			return nil
+		},
+	}}})
+
+	now := time.Now()
+	token := func(issuer *servertest.Issuer, claims servertest.Claims) string {
+		if _, ok := claims["aud"]; !ok {
+			claims["aud"] = "api-1"
+		}
+		token, err := issuer.Token(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	unknownKey, _ := servertest.NewKey("RS256")
+	unknownKeyToken, _ := issuer.TokenWithKey(unknownKey, servertest.Claims{"sub": "user-1", "aud": "api-1"})
+	forgedKey := *unknownKey
+	forgedKey.ID = issuer.Key().ID
+	forgedToken, _ := issuer.TokenWithKey(&forgedKey, servertest.Claims{"sub": "user-1", "aud": "api-1"})
+
+	ts := []struct {
+		name          string
+		authorization string
+		code          int
+		message       string
+	}{
+		{name: "valid", authorization: "Bearer " + token(issuer, servertest.Claims{"sub": "user-1"}), code: http.StatusOK},
+		{name: "second issuer and audience", authorization: "Bearer " + token(otherIssuer, servertest.Claims{"sub": "user-1", "aud": []string{"other", "api-2"}}), code: http.StatusOK},
+		{name: "expired within skew", authorization: "Bearer " + token(issuer, servertest.Claims{"sub": "user-1", "exp": now.Add(-30 * time.Second).Unix()}), code: http.StatusOK},
+		{name: "not before within skew", authorization: "Bearer " + token(issuer, servertest.Claims{"sub": "user-1", "nbf": now.Add(30 * time.Second).Unix()}), code: http.StatusOK},
+		{name: "missing", authorization: "", code: http.StatusUnauthorized, message: "token_missing"},
+		{name: "not a bearer token", authorization: "Basic dXNlcjpwYXNz", code: http.StatusUnauthorized, message: "token_missing"},
+		{name: "malformed", authorization: "Bearer not-a-token", code: http.StatusUnauthorized, message: "token_malformed"},
+		{name: "expired", authorization: "Bearer " + token(issuer, servertest.Claims{"sub": "user-1", "exp": now.Add(-2 * time.Minute).Unix()}), code: http.StatusUnauthorized, message: "token_expired"},
+		{name: "not before", authorization: "Bearer " + token(issuer, servertest.Claims{"sub": "user-1", "nbf": now.Add(2 * time.Minute).Unix()}), code: http.StatusUnauthorized, message: "token_not_yet_valid"},
+		{name: "issued in the future", authorization: "Bearer " + token(issuer, servertest.Claims{"sub": "user-1", "iat": now.Add(2 * time.Minute).Unix()}), code: http.StatusUnauthorized, message: "token_not_yet_valid"},
+		{name: "unknown issuer", authorization: "Bearer " + token(unknownIssuer, servertest.Claims{"sub": "user-1"}), code: http.StatusUnauthorized, message: "invalid_issuer"},
+		{name: "wrong audience", authorization: "Bearer " + token(issuer, servertest.Claims{"sub": "user-1", "aud": "api-3"}), code: http.StatusUnauthorized, message: "invalid_audience"},
+		{name: "unknown key", authorization: "Bearer " + unknownKeyToken, code: http.StatusUnauthorized, message: "unknown_key_id"},
+		{name: "bad signature", authorization: "Bearer " + forgedToken, code: http.StatusUnauthorized, message: "invalid_signature"},
+		{name: "custom validator", authorization: "Bearer " + token(issuer, servertest.Claims{"sub": "blocked"}), code: http.StatusUnauthorized, message: "invalid_claims"},
+	}
+	for _, tc := range ts {
+		t.Run(tc.name, func(t *testing.T) {
+			request := httptest.NewRequest("GET", "/jwt", nil)
+			if tc.authorization != "" {
+				request.Header.Set("Authorization", tc.authorization)
+			}
+			responseRecorder := httptest.NewRecorder()
+			srv.GetMainHandler().ServeHTTP(responseRecorder, request)
+			if responseRecorder.Code != tc.code {
+				t.Fatalf("expected %d but got %d: %s", tc.code, responseRecorder.Code, responseRecorder.Body.String())
+			}
+			if tc.code == http.StatusOK {
+				return
+			}
+			jerr := server.JSONErrorResponse{}
+			err := json.Unmarshal(responseRecorder.Body.Bytes(), &jerr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if jerr.Message != tc.message {
+				t.Errorf("expected message %s but got %s", tc.message, jerr.Message)
+			}
+		})
+	}
+
+	srv = server.CreateServer(config, []server.ControllerProvider{jwtOptionsProvider{opts: server.JWTOptions{
+		Issuers:        []string{issuer.URL},
+		QueryParameter: "access_token",
+	}}})
+	request := httptest.NewRequest("GET", "/jwt?access_token="+token(issuer, servertest.Claims{"sub": "user-1"}), nil)
+	responseRecorder := httptest.NewRecorder()
+	srv.GetMainHandler().ServeHTTP(responseRecorder, request)
+	if responseRecorder.Code != http.StatusOK || responseRecorder.Body.String() != "user-1" {
+		t.Errorf("token from query parameter not accepted: %d %s", responseRecorder.Code, responseRecorder.Body.String())
+	}
+}
+
+type corsProvider struct{}
+
+func (p corsProvider) GetControllers() []server.Controller {
+	ok := func(ctx *server.Context) {
+		ctx.SendHTMLResponse(http.StatusOK, []byte("ok"))
+	}
+	return []server.Controller{
+		{Name: "ListItems", Metric: "ListItems", Methods: []string{"GET"}, Path: "/items", ControllerFunc: ok},
+		{Name: "CreateItem", Metric: "CreateItem", Methods: []string{"POST"}, Path: "/items", ControllerFunc: ok},
+		{Name: "SameOrigin", Metric: "SameOrigin", Methods: []string{"GET"}, Path: "/internal", ControllerFunc: ok, CORS: &server.CORSOptions{}},
+		{Name: "OwnOptions", Metric: "OwnOptions", Methods: []string{"GET", "OPTIONS"}, Path: "/own", ControllerFunc: func(ctx *server.Context) {
+			ctx.SendHTMLResponse(http.StatusTeapot, nil)
+		}},
+		{
+			Name:           "Secured",
+			Metric:         "Secured",
+			Methods:        []string{"GET"},
+			Path:           "/secured",
+			IsSecured:      true,
+			AuthFunc:       func(ctx *server.Context) error { return server.ErrMissingCredentials },
+			ControllerFunc: ok,
+		},
+	}
+}
+
+func TestCORS(t *testing.T) {
+	config := server.CreateConfig("./", "minimal", ConfigProperties)
+	config.SetProperty(server.ConfigCORSAllowedOrigins, "https://app.example.com, https://*.example.org")
+	config.SetProperty(server.ConfigCORSAllowCredentials, "true")
+	config.SetProperty(server.ConfigCORSMaxAge, "10m")
+	srv := server.CreateServer(config, []server.ControllerProvider{corsProvider{}})
+
+	ts := []struct {
+		name    string
+		method  string
+		path    string
+		headers map[string]string
+		code    int
+		expect  map[string]string
+	}{
+		{
+			name:    "preflight",
+			method:  "OPTIONS",
+			path:    "/items",
+			headers: map[string]string{"Origin": "https://app.example.com", "Access-Control-Request-Method": "POST", "Access-Control-Request-Headers": "content-type, authorization"},
+			code:    http.StatusNoContent,
+			expect: map[string]string{
+				"Access-Control-Allow-Origin":      "https://app.example.com",
+				"Access-Control-Allow-Methods":     "GET, POST",
+				"Access-Control-Allow-Headers":     "content-type, authorization",
+				"Access-Control-Allow-Credentials": "true",
+				"Access-Control-Max-Age":           "600",
+			},
+		},
+		{
+			name:    "preflight wildcard subdomain",
+			method:  "OPTIONS",
+			path:    "/items",
+			headers: map[string]string{"Origin": "https://tenant.example.org", "Access-Control-Request-Method": "GET"},
+			code:    http.StatusNoContent,
+			expect:  map[string]string{"Access-Control-Allow-Origin": "https://tenant.example.org"},
+		},
+		{
+			name:    "preflight origin not allowed",
+			method:  "OPTIONS",
+			path:    "/items",
+			headers: map[string]string{"Origin": "https://example.org", "Access-Control-Request-Method": "GET"},
+			code:    http.StatusForbidden,
+			expect:  map[string]string{"Access-Control-Allow-Origin": ""},
+		},
+		{
+			name:    "preflight method not allowed",
+			method:  "OPTIONS",
+			path:    "/items",
+			headers: map[string]string{"Origin": "https://app.example.com", "Access-Control-Request-Method": "DELETE"},
+			code:    http.StatusForbidden,
+		},
+		{
+			name:    "preflight header not allowed",
+			method:  "OPTIONS",
+			path:    "/items",
+			headers: map[string]string{"Origin": "https://app.example.com", "Access-Control-Request-Method": "GET", "Access-Control-Request-Headers": "X-Custom"},
+			code:    http.StatusForbidden,
+		},
+		{
+			name:   "options without origin",
+			method: "OPTIONS",
+			path:   "/items",
+			code:   http.StatusNoContent,
+			expect: map[string]string{"Allow": "GET, POST, OPTIONS"},
+		},
+		{
+			name:    "actual request",
+			method:  "GET",
+			path:    "/items",
+			headers: map[string]string{"Origin": "https://app.example.com"},
+			code:    http.StatusOK,
+			expect: map[string]string{
+				"Access-Control-Allow-Origin":      "https://app.example.com",
+				"Access-Control-Allow-Credentials": "true",
+				"Access-Control-Expose-Headers":    "X-Request-ID",
+				"Vary":                             "Origin",
+			},
+		},
+		{
+			name:    "actual request of other origin",
+			method:  "GET",
+			path:    "/items",
+			headers: map[string]string{"Origin": "https://evil.com"},
+			code:    http.StatusOK,
+			expect:  map[string]string{"Access-Control-Allow-Origin": ""},
+		},
+		{
+			name:    "error responses carry CORS headers",
+			method:  "GET",
+			path:    "/secured",
+			headers: map[string]string{"Origin": "https://app.example.com"},
+			code:    http.StatusUnauthorized,
+			expect:  map[string]string{"Access-Control-Allow-Origin": "https://app.example.com"},
+		},
+		{
+			name:    "disabled for controller",
+			method:  "OPTIONS",
+			path:    "/internal",
+			headers: map[string]string{"Origin": "https://app.example.com", "Access-Control-Request-Method": "GET"},
+			code:    http.StatusMethodNotAllowed,
+		},
+		{
+			name:    "controller handling OPTIONS itself",
+			method:  "OPTIONS",
+			path:    "/own",
+			headers: map[string]string{"Origin": "https://app.example.com", "Access-Control-Request-Method": "GET"},
+			code:    http.StatusTeapot,
+		},
+	}
+	for _, tc := range ts {
+		t.Run(tc.name, func(t *testing.T) {
+			request := httptest.NewRequest(tc.method, tc.path, nil)
+			for k, v := range tc.headers {
+				request.Header.Set(k, v)
+			}
+			responseRecorder := httptest.NewRecorder()
+			srv.GetMainHandler().ServeHTTP(responseRecorder, request)
+			if responseRecorder.Code != tc.code {
+				t.Errorf("expected %d but got %d", tc.code, responseRecorder.Code)
+			}
+			for k, v := range tc.expect {
+				if got := responseRecorder.Header().Get(k); got != v {
+					t.Errorf("expected header %s to be %q but got %q", k, v, got)
+				}
+			}
+			if responseRecorder.Header().Get(server.HeaderRequestID) == "" {
+				t.Error("request id not set on response")
+			}
+		})
+	}
+}
+
+func TestCORSAnyOrigin(t *testing.T) {
+	config := server.CreateConfig("./", "minimal", ConfigProperties)
+	config.SetProperty(server.ConfigCORSAllowedOrigins, "*")
+	srv := server.CreateServer(config, []server.ControllerProvider{corsProvider{}})
+	for _, method := range []string{"OPTIONS", "GET"} {
+		request := httptest.NewRequest(method, "/items", nil)
+		request.Header.Set("Origin", "https://evil.com")
+		request.Header.Set("Access-Control-Request-Method", "GET")
+		responseRecorder := httptest.NewRecorder()
+		srv.GetMainHandler().ServeHTTP(responseRecorder, request)
+		header := responseRecorder.Header()
+		if header.Get("Access-Control-Allow-Origin") != "*" || header.Get("Access-Control-Allow-Credentials") != "" {
+			t.Errorf("%s: expected a literal * without credentials but got %v", method, header)
+		}
+	}
+
+	// credentials for any origin are rejected on startup
+	expectPanic := func(name string, create func()) {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("%s: credentials for any origin were accepted", name)
+			}
+		}()
+		create()
+	}
+	expectPanic("config", func() {
+		config := server.CreateConfig("./", "minimal", ConfigProperties)
+		config.SetProperty(server.ConfigCORSAllowedOrigins, "https://app.example.com, *")
+		config.SetProperty(server.ConfigCORSAllowCredentials, "true")
+		server.CreateServer(config, nil)
+	})
+	expectPanic("controller", func() {
+		server.CreateServer(server.CreateConfig("./", "minimal", ConfigProperties), []server.ControllerProvider{corsCredentialsProvider{}})
+	})
+}
+
+type corsCredentialsProvider struct{}
+
+func (p corsCredentialsProvider) GetControllers() []server.Controller {
+	return []server.Controller{{
+		Name:           "AnyOrigin",
+		Metric:         "AnyOrigin",
+		Methods:        []string{"GET"},
+		Path:           "/any",
+		ControllerFunc: func(ctx *server.Context) {},
+		CORS:           &server.CORSOptions{AllowedOrigins: []string{"*"}, AllowCredentials: true},
+	}}
+}
+
+type rateLimitProvider struct {
+	authAttempts *atomic.Int32
+}
+
+func (p rateLimitProvider) GetControllers() []server.Controller {
+	ok := func(ctx *server.Context) {
+		ctx.SendHTMLResponse(http.StatusOK, []byte("ok"))
+	}
+	login := func(ctx *server.Context) error {
+		p.authAttempts.Add(1)
+		if ctx.Request.Header.Get("X-Password") != "secret" {
+			return server.ErrInvalidCredentials
+		}
+		ctx.SetPrincipal(&server.Principal{Subject: ctx.Request.Header.Get("X-User")})
+		return nil
+	}
+	return []server.Controller{
+		{
+			Name:           "LoginByIP",
+			Metric:         "LoginByIP",
+			Methods:        []string{"GET"},
+			Path:           "/login/ip",
+			IsSecured:      true,
+			AuthFunc:       login,
+			ControllerFunc: ok,
+			RateLimit:      &server.RateLimit{Requests: 2, Window: time.Minute},
+		},
+		{
+			Name:           "LoginBySubject",
+			Metric:         "LoginBySubject",
+			Methods:        []string{"GET"},
+			Path:           "/login/subject",
+			IsSecured:      true,
+			AuthFunc:       login,
+			ControllerFunc: ok,
+			RateLimit:      &server.RateLimit{Requests: 2, Window: time.Minute, Key: server.RateLimitBySubject},
+		},
+		{
+			Name:           "LimitedByIP",
+			Metric:         "LimitedByIP",
+			Methods:        []string{"GET"},
+			Path:           "/ip",
+			ControllerFunc: ok,
+			RateLimit:      &server.RateLimit{Requests: 2, Window: time.Minute},
+		},
+		{
+			Name:      "LimitedBySubject",
+			Metric:    "LimitedBySubject",
+			Methods:   []string{"GET"},
+			Path:      "/subject",
+			IsSecured: true,
+			AuthFunc: func(ctx *server.Context) error {
+				ctx.SetPrincipal(&server.Principal{Subject: ctx.Request.Header.Get("X-User")})
+				return nil
+			},
+			ControllerFunc: ok,
+			RateLimit:      &server.RateLimit{Requests: 1, Window: time.Hour, Key: server.RateLimitBySubject},
+		},
+	}
+}
+
+type failingRateLimitStore struct {
+	keys []string
+}
+
+func (f *failingRateLimitStore) Take(ctx context.Context, key string, limit server.RateLimit) (server.RateLimitResult, error) {
+	f.keys = append(f.keys, key)
+	return server.RateLimitResult{}, errors.New("store unavailable")
+}
+
+func TestRateLimit(t *testing.T) {
+	config := server.CreateConfig("./", "minimal", ConfigProperties)
+	config.SetProperty(server.ConfigTrustProxyHeaders, "true")
+	authAttempts := &atomic.Int32{}
+	srv := server.CreateServer(config, []server.ControllerProvider{rateLimitProvider{authAttempts: authAttempts}})
+	call := func(path string, headers map[string]string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest("GET", path, nil)
+		for k, v := range headers {
+			request.Header.Set(k, v)
+		}
+		responseRecorder := httptest.NewRecorder()
+		srv.GetMainHandler().ServeHTTP(responseRecorder, request)
+		return responseRecorder
+	}
+
+	for i := 0; i < 2; i++ {
+		resp := call("/ip", nil)
+		if resp.Code != http.StatusOK {
+			t.Fatalf("request %d was rejected: %d", i, resp.Code)
+		}
+		if resp.Header().Get("RateLimit-Limit") != "2" || resp.Header().Get("RateLimit-Remaining") != fmt.Sprint(1-i) {
+			t.Errorf("unexpected RateLimit headers: %v", resp.Header())
+		}
+	}
+	resp := call("/ip", nil)
+	if resp.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected %d but got %d", http.StatusTooManyRequests, resp.Code)
+	}
+	if retryAfter := resp.Header().Get("Retry-After"); retryAfter != "30" {
+		t.Errorf("expected Retry-After 30 but got %s", retryAfter)
+	}
+	if reset := resp.Header().Get("RateLimit-Reset"); reset != "60" {
+		t.Errorf("expected RateLimit-Reset 60 but got %s", reset)
+	}
+	jerr := server.JSONErrorResponse{}
+	json.Unmarshal(resp.Body.Bytes(), &jerr)
+	if jerr.Message != "too_many_requests" {
+		t.Errorf("unexpected error response: %s", resp.Body.String())
+	}
+	if resp := call("/ip", map[string]string{"X-Forwarded-For": "203.0.113.7, 10.0.0.1"}); resp.Code != http.StatusOK {
+		t.Errorf("other client was rejected: %d", resp.Code)
+	}
+	// entries in front of the one added by the proxy are controlled by the client
+	accepted := 0
+	for i := 0; i < 3; i++ {
+		if resp := call("/ip", map[string]string{"X-Forwarded-For": fmt.Sprintf("198.51.100.%d, 10.0.0.1", i)}); resp.Code == http.StatusOK {
+			accepted++
+		}
+	}
+	if accepted != 1 {
+		t.Errorf("spoofed X-Forwarded-For entries bypassed the limit: %d requests accepted", accepted)
+	}
+
+	if resp := call("/subject", map[string]string{"X-User": "alice"}); resp.Code != http.StatusOK {
+		t.Errorf("first request of alice was rejected: %d", resp.Code)
+	}
+	if resp := call("/subject", map[string]string{"X-User": "alice"}); resp.Code != http.StatusTooManyRequests {
+		t.Errorf("second request of alice wasn't rejected: %d", resp.Code)
+	}
+	if resp := call("/subject", map[string]string{"X-User": "bob"}); resp.Code != http.StatusOK {
+		t.Errorf("request of bob was rejected: %d", resp.Code)
+	}
+
+	// failed logins are limited as well
+	for i, expected := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests} {
+		if resp := call("/login/ip", map[string]string{"X-Password": "guess"}); resp.Code != expected {
+			t.Errorf("login attempt %d: expected %d but got %d", i, expected, resp.Code)
+		}
+	}
+	if authAttempts.Load() != 3 {
+		t.Errorf("expected auth function to be called 3 times but was called %d times", authAttempts.Load())
+	}
+	if resp := call("/login/ip", map[string]string{"X-Password": "secret"}); resp.Code != http.StatusTooManyRequests {
+		t.Errorf("successful login didn't count against the exhausted limit: %d", resp.Code)
+	}
+	// limits by subject charge failed attempts to the client IP
+	for i, expected := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests} {
+		if resp := call("/login/subject", map[string]string{"X-User": "alice", "X-Password": "guess"}); resp.Code != expected {
+			t.Errorf("login attempt %d: expected %d but got %d", i, expected, resp.Code)
+		}
+	}
+	if resp := call("/login/subject", map[string]string{"X-User": "alice", "X-Password": "secret"}); resp.Code != http.StatusOK {
+		t.Errorf("successful login of alice was rejected: %d", resp.Code)
+	}
+
+	if rejected := srv.GetStatus().Metrics[server.MetricRateLimited]; rejected != 7 {
+		t.Errorf("expected 7 rejections in the status information but got %d", rejected)
+	}
+
+	// the zero value of the memory store is usable
+	result, err := (&server.MemoryRateLimitStore{}).Take(context.Background(), "key", server.RateLimit{Requests: 1, Window: time.Minute})
+	if err != nil || !result.Allowed {
+		t.Errorf("zero value store rejected the request: %+v, %v", result, err)
+	}
+
+	// the limiter fails open
+	store := &failingRateLimitStore{}
+	srv = server.CreateServer(config, []server.ControllerProvider{rateLimitProvider{authAttempts: authAttempts}})
+	srv.SetRateLimitStore(store)
+	for i := 0; i < 3; i++ {
+		if resp := call("/ip", nil); resp.Code != http.StatusOK {
+			t.Errorf("request was rejected although the store failed: %d", resp.Code)
+		}
+	}
+	if len(store.keys) != 3 || store.keys[0] != "LimitedByIP|ip:192.0.2.1" {
+		t.Errorf("unexpected keys: %v", store.keys)
+	}
+}
+
+type tenantInfo struct {
+	Name string
+}
+
+type tenantProvider struct{}
+
+func (p tenantProvider) GetControllers() []server.Controller {
+	return []server.Controller{
+		{
+			Name:       "AdminHome",
+			Metric:     "AdminHome",
+			Methods:    []string{"GET"},
+			Path:       "/home",
+			Subdomains: []string{"admin"},
+			ControllerFunc: func(ctx *server.Context) {
+				ctx.SendHTMLResponse(http.StatusOK, []byte("admin"))
+			},
+		},
+		{
+			Name:       "TenantHome",
+			Metric:     "TenantHome",
+			Methods:    []string{"GET"},
+			Path:       "/home",
+			Subdomains: []string{"*"},
+			ControllerFunc: func(ctx *server.Context) {
+				ctx.Logger().Info("tenant home")
+				ctx.SendHTMLResponse(http.StatusOK, []byte(ctx.Tenant().(tenantInfo).Name))
+			},
+		},
+		{
+			Name:       "Landing",
+			Metric:     "Landing",
+			Methods:    []string{"GET"},
+			Path:       "/home",
+			Subdomains: []string{""},
+			ControllerFunc: func(ctx *server.Context) {
+				ctx.SendHTMLResponse(http.StatusOK, []byte("landing"))
+			},
+		},
+		{
+			Name:       "Beta",
+			Metric:     "Beta",
+			Methods:    []string{"GET"},
+			Path:       "/beta",
+			Subdomains: []string{"beta-*"},
+			ControllerFunc: func(ctx *server.Context) {
+				ctx.SendHTMLResponse(http.StatusOK, []byte(ctx.Subdomain))
+			},
+		},
+	}
+}
+
+func TestTenants(t *testing.T) {
+	config := server.CreateConfig("./", "minimal", ConfigProperties)
+	config.SetProperty(server.ConfigBaseDomains, "example.com, Example.org")
+	config.SetProperty(server.ConfigTrustProxyHeaders, "true")
+	config.SetProperty(server.ConfigEnablePrometheus, "true")
+	srv := server.CreateServer(config, []server.ControllerProvider{tenantProvider{}})
+	buf := bytes.Buffer{}
+	srv.SetLogHandler(slog.NewJSONHandler(&buf, nil))
+	tenants := map[string]tenantInfo{"acme": {Name: "ACME Corp"}, "beta-1": {Name: "Beta 1"}}
+	srv.SetTenantResolver(func(ctx *server.Context, subdomain string) (any, error) {
+		if subdomain == "admin" {
+			return nil, nil
+		}
+		if subdomain == "broken" {
+			return nil, errors.New("tenant database unavailable")
+		}
+		tenant, ok := tenants[subdomain]
+		if !ok {
+			return nil, server.ErrUnknownTenant
+		}
+		return tenant, nil
+	})
+
+	ts := []struct {
+		name    string
+		host    string
+		path    string
+		headers map[string]string
+		code    int
+		body    string
+	}{
+		{name: "tenant", host: "acme.example.com", path: "/home", code: http.StatusOK, body: "ACME Corp"},
+		{name: "second base domain", host: "ACME.example.org:8080", path: "/home", code: http.StatusOK, body: "ACME Corp"},
+		{name: "restricted to subdomain", host: "admin.example.com", path: "/home", code: http.StatusOK, body: "admin"},
+		{name: "no subdomain", host: "example.com", path: "/home", code: http.StatusOK, body: "landing"},
+		{name: "other domain", host: "acme.other.com", path: "/home", code: http.StatusOK, body: "landing"},
+		{name: "forwarded host", host: "internal:8080", path: "/home", headers: map[string]string{"X-Forwarded-Host": "acme.example.com"}, code: http.StatusOK, body: "ACME Corp"},
+		{name: "spoofed forwarded host", host: "internal:8080", path: "/home", headers: map[string]string{"X-Forwarded-Host": "admin.example.com, acme.example.com"}, code: http.StatusOK, body: "ACME Corp"},
+		{name: "pattern", host: "beta-1.example.com", path: "/beta", code: http.StatusOK, body: "beta-1"},
+		{name: "pattern not matching", host: "acme.example.com", path: "/beta", code: http.StatusNotFound},
+		{name: "unknown tenant", host: "unknown.example.com", path: "/home", code: http.StatusNotFound, body: "unknown_tenant"},
+		{name: "resolver failing", host: "broken.example.com", path: "/home", code: http.StatusInternalServerError},
+	}
+	for _, tc := range ts {
+		t.Run(tc.name, func(t *testing.T) {
+			request := httptest.NewRequest("GET", tc.path, nil)
+			request.Host = tc.host
+			for k, v := range tc.headers {
+				request.Header.Set(k, v)
+			}
+			responseRecorder := httptest.NewRecorder()
+			srv.GetMainHandler().ServeHTTP(responseRecorder, request)
+			if responseRecorder.Code != tc.code {
+				t.Errorf("expected %d but got %d", tc.code, responseRecorder.Code)
+			}
+			if !strings.Contains(responseRecorder.Body.String(), tc.body) {
+				t.Errorf("expected body to contain %q but got %q", tc.body, responseRecorder.Body.String())
+			}
+		})
+	}
+
+	if !strings.Contains(buf.String(), `"tenant":"acme"`) {
+		t.Errorf("tenant missing in logs: %s", buf.String())
+	}
+	request := httptest.NewRequest("GET", "/metrics", nil)
+	responseRecorder := httptest.NewRecorder()
+	srv.GetMainHandler().ServeHTTP(responseRecorder, request)
+	expected := `ssf_server_controller_requestcount_count{code="200",controller="TenantHome",method="GET",route="/home",tenant="acme"} 4`
+	if !strings.Contains(responseRecorder.Body.String(), expected) {
+		t.Errorf("metrics don't contain %s", expected)
+	}
+
+	// subdomains rejected by the resolver don't create new label values
+	for i := 0; i < 3; i++ {
+		request := httptest.NewRequest("GET", "/home", nil)
+		request.Host = fmt.Sprintf("random-%d.example.com", i)
+		srv.GetMainHandler().ServeHTTP(httptest.NewRecorder(), request)
+	}
+	responseRecorder = httptest.NewRecorder()
+	srv.GetMainHandler().ServeHTTP(responseRecorder, httptest.NewRequest("GET", "/metrics", nil))
+	if strings.Contains(responseRecorder.Body.String(), `tenant="random-`) {
+		t.Error("rejected subdomains used as metric labels")
+	}
+	expected = `ssf_server_controller_requestcount_count{code="404",controller="TenantHome",method="GET",route="/home",tenant="*"} 4`
+	if !strings.Contains(responseRecorder.Body.String(), expected) {
+		t.Errorf("metrics don't contain %s", expected)
+	}
+}
+
+type sseProvider struct {
+	closed chan struct{}
+}
+
+func (p sseProvider) GetControllers() []server.Controller {
+	return []server.Controller{
+		{
+			Name:    "Events",
+			Metric:  "Events",
+			Methods: []string{"GET"},
+			Path:    "/events",
+			ControllerFunc: func(ctx *server.Context) {
+				stream, err := ctx.StartSSE()
+				if err != nil {
+					ctx.SendJsonError(err)
+					return
+				}
+				for i := 1; i <= 5; i++ {
+					time.Sleep(100 * time.Millisecond)
+					err = stream.Send(server.SSEEvent{ID: fmt.Sprint(i), Event: "progress", Data: fmt.Sprintf("step %d\nof 5", i)})
+					if err != nil {
+						ctx.LogError(err.Error())
+						return
+					}
+				}
+				// line breaks can't inject fields
+				if stream.Send(server.SSEEvent{ID: "6\nevent: admin", Data: "x"}) == nil {
+					ctx.LogError("id with line break was sent")
+				}
+				if stream.Send(server.SSEEvent{Event: "summary\r", Data: "x"}) == nil {
+					ctx.LogError("event with line break was sent")
+				}
+				stream.Send(server.SSEEvent{Event: "summary", Data: "5 steps\rretry: 1"})
+				stream.SendJSON("done", map[string]int{"steps": 5})
+			},
+		},
+		{
+			Name:    "Forever",
+			Metric:  "Forever",
+			Methods: []string{"GET"},
+			Path:    "/forever",
+			ControllerFunc: func(ctx *server.Context) {
+				stream, err := ctx.StartSSE()
+				if err != nil {
+					ctx.SendJsonError(err)
+					return
+				}
+				stream.Send(server.SSEEvent{Data: "hello"})
+				<-stream.Done()
+				close(p.closed)
+			},
+		},
+	}
+}
+
+func TestSSE(t *testing.T) {
+	config := server.CreateConfig("./", "minimal", ConfigProperties)
+	config.SetProperty(server.ConfigWriteTimeout, "200ms")
+	config.SetProperty(server.ConfigSSEHeartbeatInterval, "40ms")
+	config.SetProperty(server.ConfigEnablePrometheus, "true")
+	provider := sseProvider{closed: make(chan struct{})}
+	srv := server.CreateServer(config, []server.ControllerProvider{provider})
+	httpSrv := httptest.NewUnstartedServer(srv.GetMainHandler())
+	httpSrv.Config.WriteTimeout = 200 * time.Millisecond
+	httpSrv.Start()
+	defer httpSrv.Close()
+
+	// the stream outlives the write timeout
+	resp, err := http.Get(httpSrv.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("stream was interrupted: %s", err)
+	}
+	if resp.Header.Get("Content-Type") != "text/event-stream" || resp.Header.Get("Cache-Control") != "no-cache" {
+		t.Errorf("unexpected headers: %v", resp.Header)
+	}
+	for _, expected := range []string{
+		"id: 1\nevent: progress\ndata: step 1\ndata: of 5\n\n",
+		"id: 5\nevent: progress\ndata: step 5\ndata: of 5\n\n",
+		"event: summary\ndata: 5 steps\ndata: retry: 1\n\n",
+		"event: done\ndata: {\"steps\":5}\n\n",
+		": heartbeat\n\n",
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("stream doesn't contain %q: %s", expected, body)
+		}
+	}
+	if strings.Contains(string(body), "admin") || strings.Contains(string(body), "\r") {
+		t.Errorf("line breaks injected fields: %q", body)
+	}
+
+	// the stream ends when the client disconnects
+	reqCtx, cancel := context.WithCancel(context.Background())
+	request, _ := http.NewRequestWithContext(reqCtx, "GET", httpSrv.URL+"/forever", nil)
+	resp, err = http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, _ := bufio.NewReader(resp.Body).ReadString('\n')
+	if line != "data: hello\n" {
+		t.Errorf("unexpected first line: %q", line)
+	}
+	cancel()
+	resp.Body.Close()
+	select {
+	case <-provider.closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("stream wasn't closed after the client disconnected")
+	}
+
+	request = httptest.NewRequest("GET", "/metrics", nil)
+	responseRecorder := httptest.NewRecorder()
+	srv.GetMainHandler().ServeHTTP(responseRecorder, request)
+	for _, expected := range []string{
+		`ssf_server_stream_duration_seconds_count{controller="Events",type="sse"} 1`,
+		`ssf_server_stream_duration_seconds_count{controller="Forever",type="sse"} 1`,
+	} {
+		if !strings.Contains(responseRecorder.Body.String(), expected) {
+			t.Errorf("metrics don't contain %s", expected)
+		}
+	}
+}
+
+type webSocketProvider struct {
+	pushEnded chan struct{}
+}
+
+func (p webSocketProvider) GetControllers() []server.Controller {
+	return []server.Controller{
+		{
+			Name:    "Push",
+			Metric:  "Push",
+			Methods: []string{"GET"},
+			Path:    "/ws/push",
+			WebSocketFunc: func(ctx *server.Context, conn *server.WebSocketConn) {
+				defer close(p.pushEnded)
+				ticker := time.NewTicker(20 * time.Millisecond)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-conn.Done():
+						return
+					case <-ticker.C:
+						conn.WriteMessage(server.TextMessage, []byte("tick"))
+					}
+				}
+			},
+		},
+		{
+			Name:      "Echo",
+			Metric:    "Echo",
+			Methods:   []string{"GET"},
+			Path:      "/ws",
+			IsSecured: true,
+			AuthFunc: func(ctx *server.Context) error {
+				if ctx.Request.Header.Get("X-Token") != "secret" {
+					return server.ErrInvalidCredentials
+				}
+				ctx.SetPrincipal(&server.Principal{Subject: "alice"})
+				return nil
+			},
+			WebSocketFunc: func(ctx *server.Context, conn *server.WebSocketConn) {
+				for {
+					msg := map[string]string{}
+					err := conn.ReadJSON(&msg)
+					if err != nil {
+						return
+					}
+					conn.WriteJSON(map[string]string{
+						"echo":       msg["text"],
+						"subject":    ctx.Principal().Subject,
+						"request_id": ctx.GetRequestID(),
+					})
+				}
+			},
+		},
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	config := server.CreateConfig("./", "minimal", ConfigProperties)
+	config.SetProperty(server.ConfigWebSocketPingInterval, "50ms")
+	config.SetProperty(server.ConfigWebSocketMaxMessageSize, "64")
+	config.SetProperty(server.ConfigEnablePrometheus, "true")
+	pushEnded := make(chan struct{})
+	srv := server.CreateServer(config, []server.ControllerProvider{webSocketProvider{pushEnded: pushEnded}})
+	httpSrv := httptest.NewServer(srv.GetMainHandler())
+	defer httpSrv.Close()
+	url := "ws" + strings.TrimPrefix(httpSrv.URL, "http") + "/ws"
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected unauthenticated upgrade to fail with 401: %v", err)
+	}
+
+	header := http.Header{}
+	header.Set("X-Token", "secret")
+	header.Set("X-Request-ID", "ws-request")
+	conn, resp, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if resp.Header.Get("X-Request-ID") != "ws-request" {
+		t.Errorf("request id not echoed: %v", resp.Header)
+	}
+	var pings atomic.Int32
+	conn.SetPingHandler(func(data string) error {
+		pings.Add(1)
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+	messages := make(chan map[string]string)
+	closed := make(chan error, 1)
+	go func() {
+		for {
+			msg := map[string]string{}
+			err := conn.ReadJSON(&msg)
+			if err != nil {
+				closed <- err
+				return
+			}
+			messages <- msg
+		}
+	}()
+	receive := func() map[string]string {
+		select {
+		case msg := <-messages:
+			return msg
+		case err := <-closed:
+			t.Fatalf("connection closed: %s", err)
+		case <-time.After(2 * time.Second):
+			t.Fatal("no message received")
+		}
+		return nil
+	}
+
+	conn.WriteJSON(map[string]string{"text": "hello"})
+	msg := receive()
+	if msg["echo"] != "hello" || msg["subject"] != "alice" || msg["request_id"] != "ws-request" {
+		t.Errorf("unexpected message: %v", msg)
+	}
+
+	// the connection survives idle periods longer than the read deadline thanks to ping/pong
+	time.Sleep(300 * time.Millisecond)
+	if pings.Load() < 3 {
+		t.Errorf("expected at least 3 pings but got %d", pings.Load())
+	}
+	conn.WriteJSON(map[string]string{"text": "still there"})
+	if msg := receive(); msg["echo"] != "still there" {
+		t.Errorf("unexpected message: %v", msg)
+	}
+
+	// messages above the limit close the connection
+	conn.WriteJSON(map[string]string{"text": strings.Repeat("x", 100)})
+	select {
+	case err := <-closed:
+		if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+			t.Errorf("expected close code %d but got %v", websocket.CloseMessageTooBig, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection wasn't closed after too large message")
+	}
+
+	// push only handlers notice when the client goes away
+	pushConn, _, err := websocket.DefaultDialer.Dial(url+"/push", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, msg, err := pushConn.ReadMessage(); err != nil || string(msg) != "tick" {
+		t.Fatalf("unexpected message: %s, %v", msg, err)
+	}
+	pushConn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	pushConn.Close()
+	select {
+	case <-pushEnded:
+	case <-time.After(time.Second):
+		t.Error("push handler didn't notice the closed connection")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	request := httptest.NewRequest("GET", "/metrics", nil)
+	responseRecorder := httptest.NewRecorder()
+	srv.GetMainHandler().ServeHTTP(responseRecorder, request)
+	for _, expected := range []string{
+		`ssf_server_websocket_messages_total{controller="Echo",direction="received"} 2`,
+		`ssf_server_websocket_messages_total{controller="Echo",direction="sent"} 2`,
+		`ssf_server_stream_duration_seconds_count{controller="Echo",type="websocket"} 1`,
+		`ssf_server_stream_duration_seconds_count{controller="Push",type="websocket"} 1`,
+		`ssf_server_auth_failures_total{controller="Echo",reason="unauthenticated"} 1`,
+	} {
+		if !strings.Contains(responseRecorder.Body.String(), expected) {
+			t.Errorf("metrics don't contain %s", expected)
+		}
+	}
+}
+
+type webSocketShutdownProvider struct {
+	events    *[]string
+	connected chan struct{}
+}
+
+func (p webSocketShutdownProvider) GetControllers() []server.Controller {
+	return []server.Controller{
+		{
+			Name:    "Subscribe",
+			Metric:  "Subscribe",
+			Methods: []string{"GET"},
+			Path:    "/ws/subscribe",
+			WebSocketFunc: func(ctx *server.Context, conn *server.WebSocketConn) {
+				close(p.connected)
+				<-conn.Done()
+				time.Sleep(100 * time.Millisecond)
+				*p.events = append(*p.events, "handler returned")
+			},
+		},
+	}
+}
+
+func TestWebSocketShutdown(t *testing.T) {
+	config := server.CreateConfig("./", "minimal", ConfigProperties)
+	config.SetProperty(server.ConfigEnablePrometheus, "false")
+
+	events := []string{}
+	prov := webSocketShutdownProvider{events: &events, connected: make(chan struct{})}
+	srv := server.CreateServer(config, []server.ControllerProvider{prov})
+	srv.RegisterService("lifecycle", &lifecycleService{events: &events})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(context.Background(), l)
+	}()
+
+	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/ws/subscribe", l.Addr()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	<-prov.connected
+
+	err = srv.Shutdown(context.Background())
+	if err != nil {
+		t.Errorf("shutdown returned error: %s", err)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("serve returned error: %s", err)
+	}
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("expected close code %d but got %v", websocket.CloseGoingAway, err)
+	}
+
+	expected := []string{"service started", "handler returned", "service stopped"}
+	if !slices.Equal(events, expected) {
+		t.Errorf("unexpected lifecycle events: %+v. Expected %+v", events, expected)
+	}
+}
+
+type streamingProvider struct {
+	file string
+}
+
+func (p streamingProvider) GetControllers() []server.Controller {
+	return []server.Controller{
+		{
+			Name:    "Upload",
+			Metric:  "Upload",
+			Methods: []string{"POST"},
+			Path:    "/upload",
+			ControllerFunc: func(ctx *server.Context) {
+				body, err := ctx.GetRequestBody()
+				if err != nil {
+					ctx.SendJsonError(err)
+					return
+				}
+				ctx.SendHTMLResponse(http.StatusOK, body)
+			},
+			MaxRequestBodySize: 16,
+		},
+		{
+			Name:    "StreamedUpload",
+			Metric:  "StreamedUpload",
+			Methods: []string{"POST"},
+			Path:    "/upload/stream",
+			ControllerFunc: func(ctx *server.Context) {
+				body := ctx.RequestBodyReader()
+				defer body.Close()
+				n, err := io.Copy(io.Discard, body)
+				if err != nil {
+					ctx.SendJsonError(err)
+					return
+				}
+				ctx.SendHTMLResponse(http.StatusOK, []byte(fmt.Sprint(n)))
+			},
+		},
+		{
+			Name:    "Download",
+			Metric:  "Download",
+			Methods: []string{"GET"},
+			Path:    "/download",
+			ControllerFunc: func(ctx *server.Context) {
+				err := ctx.SendStream(http.StatusOK, "text/csv", strings.NewReader(strings.Repeat("a,b\n", 10000)))
+				if err != nil {
+					ctx.LogError(err.Error())
+				}
+			},
+		},
+		{
+			Name:    "File",
+			Metric:  "File",
+			Methods: []string{"GET"},
+			Path:    "/file",
+			ControllerFunc: func(ctx *server.Context) {
+				err := ctx.SendFile(p.file)
+				if err != nil {
+					ctx.SendJsonError(err)
+				}
+			},
+		},
+		{
+			Name:    "MissingFile",
+			Metric:  "MissingFile",
+			Methods: []string{"GET"},
+			Path:    "/file/missing",
+			ControllerFunc: func(ctx *server.Context) {
+				err := ctx.SendFile(p.file + ".missing")
+				if err != nil {
+					ctx.SendJsonError(err)
+				}
+			},
+		},
+	}
+}
+
+func TestStreaming(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "report.txt")
+	os.WriteFile(file, []byte("0123456789"), 0o600)
+	config := server.CreateConfig("./", "minimal", ConfigProperties)
+	config.SetProperty(server.ConfigMaxRequestBodySize, "1024")
+	srv := server.CreateServer(config, []server.ControllerProvider{streamingProvider{file: file}})
+	call := func(method string, path string, body io.Reader, headers map[string]string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, path, body)
+		for k, v := range headers {
+			request.Header.Set(k, v)
+		}
+		responseRecorder := httptest.NewRecorder()
+		srv.GetMainHandler().ServeHTTP(responseRecorder, request)
+		return responseRecorder
+	}
+	// readers of unknown length are sent without Content-Length
+	unknownLength := func(s string) io.Reader {
+		return io.MultiReader(strings.NewReader(s))
+	}
+	expectTooLarge := func(resp *httptest.ResponseRecorder) {
+		t.Helper()
+		jerr := server.JSONErrorResponse{}
+		json.Unmarshal(resp.Body.Bytes(), &jerr)
+		if resp.Code != http.StatusRequestEntityTooLarge || jerr.Message != "request_body_too_large" {
+			t.Errorf("expected %d but got %d: %s", http.StatusRequestEntityTooLarge, resp.Code, resp.Body.String())
+		}
+	}
+
+	if resp := call("POST", "/upload", strings.NewReader("small"), nil); resp.Code != http.StatusOK || resp.Body.String() != "small" {
+		t.Errorf("unexpected response: %d %s", resp.Code, resp.Body.String())
+	}
+	expectTooLarge(call("POST", "/upload", strings.NewReader(strings.Repeat("x", 17)), nil))
+	expectTooLarge(call("POST", "/upload", unknownLength(strings.Repeat("x", 17)), nil))
+
+	if resp := call("POST", "/upload/stream", unknownLength(strings.Repeat("x", 1000)), nil); resp.Body.String() != "1000" {
+		t.Errorf("unexpected response: %d %s", resp.Code, resp.Body.String())
+	}
+	expectTooLarge(call("POST", "/upload/stream", unknownLength(strings.Repeat("x", 2000)), nil))
+
+	resp := call("GET", "/download", nil, nil)
+	if resp.Code != http.StatusOK || resp.Header().Get("Content-Type") != "text/csv" || resp.Body.Len() != 40000 {
+		t.Errorf("unexpected download: %d %s, %d bytes", resp.Code, resp.Header().Get("Content-Type"), resp.Body.Len())
+	}
+	if !resp.Flushed {
+		t.Error("streamed response wasn't flushed")
+	}
+
+	resp = call("GET", "/file", nil, nil)
+	etag := resp.Header().Get("ETag")
+	lastModified := resp.Header().Get("Last-Modified")
+	if resp.Code != http.StatusOK || resp.Body.String() != "0123456789" || etag == "" || lastModified == "" {
+		t.Fatalf("unexpected file response: %d %v %s", resp.Code, resp.Header(), resp.Body.String())
+	}
+	if ct := resp.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("unexpected content type: %s", ct)
+	}
+	resp = call("GET", "/file", nil, map[string]string{"Range": "bytes=2-4"})
+	if resp.Code != http.StatusPartialContent || resp.Body.String() != "234" || resp.Header().Get("Content-Range") != "bytes 2-4/10" {
+		t.Errorf("unexpected range response: %d %v %s", resp.Code, resp.Header(), resp.Body.String())
+	}
+	if resp := call("GET", "/file", nil, map[string]string{"Range": "bytes=20-30"}); resp.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("expected %d but got %d", http.StatusRequestedRangeNotSatisfiable, resp.Code)
+	}
+	if resp := call("GET", "/file", nil, map[string]string{"If-None-Match": etag}); resp.Code != http.StatusNotModified || resp.Body.Len() > 0 {
+		t.Errorf("expected %d but got %d", http.StatusNotModified, resp.Code)
+	}
+	if resp := call("GET", "/file", nil, map[string]string{"If-Modified-Since": lastModified}); resp.Code != http.StatusNotModified {
+		t.Errorf("expected %d but got %d", http.StatusNotModified, resp.Code)
+	}
+	if resp := call("GET", "/file", nil, map[string]string{"Range": "bytes=0-1", "If-Range": `"outdated"`}); resp.Code != http.StatusOK || resp.Body.Len() != 10 {
+		t.Errorf("outdated If-Range must return the full file but got %d", resp.Code)
+	}
+	if resp := call("GET", "/file/missing", nil, nil); resp.Code != http.StatusNotFound {
+		t.Errorf("expected %d but got %d", http.StatusNotFound, resp.Code)
+	}
+}
+
+func TestInvalidConfigValues(t *testing.T) {
+	for property, value := range map[string]string{
+		server.ConfigHTTPClientTimeout:       "5",
+		server.ConfigJWKSRefreshInterval:     "hourly",
+		server.ConfigJWTClockSkew:            "1 minute",
+		server.ConfigSSEHeartbeatInterval:    "-1s",
+		server.ConfigMaxRequestBodySize:      "10MB",
+		server.ConfigWebSocketMaxMessageSize: "-1",
+		server.ConfigWebSocketPingInterval:   "often",
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("invalid %s %s was accepted", property, value)
+				}
+			}()
+			config := server.CreateConfig("./", "minimal", ConfigProperties)
+			config.SetProperty(property, value)
+			server.CreateServer(config, nil)
+		}()
+	}
+}
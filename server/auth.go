@@ -0,0 +1,419 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// AuthFunc authenticates the request of a secured controller. On success it sets the
+// Principal of the context. If it returns an error, the request is rejected with 401
+// unless the function sent a response itself.
+type AuthFunc func(ctx *Context) error
+
+// Errors returned by the built-in auth functions
+var (
+	ErrMissingCredentials = errors.New("missing credentials")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Headers of requests signed with SignRequest and verified by GetHMACAuth
+const (
+	HeaderHMACKeyID     = "X-Key-ID"
+	HeaderHMACTimestamp = "X-Timestamp"
+	HeaderHMACNonce     = "X-Nonce"
+	HeaderHMACSignature = "X-Signature"
+)
+
+const (
+	defaultHMACMaxSkew = 5 * time.Minute
+)
+
+// AnyOf succeeds as soon as one of the given auth functions succeeds. They are tried in order.
+func AnyOf(authFuncs ...AuthFunc) AuthFunc {
+	return func(ctx *Context) error {
+		errs := []error{}
+		for _, authFunc := range authFuncs {
+			err := authFunc(ctx)
+			if err == nil {
+				return nil
+			}
+			errs = append(errs, err)
+		}
+		return fmt.Errorf("all auth functions failed: %w", errors.Join(errs...))
+	}
+}
+
+// AllOf succeeds only if all given auth functions succeed. It stops at the first failure.
+func AllOf(authFuncs ...AuthFunc) AuthFunc {
+	return func(ctx *Context) error {
+		for _, authFunc := range authFuncs {
+			err := authFunc(ctx)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// APIKeyLookup resolves an API key to the name of its owner
+type APIKeyLookup interface {
+	LookupAPIKey(ctx *Context, key string) (name string, err error)
+}
+
+// StaticAPIKeys maps names to API keys, e.g. read from the config
+type StaticAPIKeys map[string]string
+
+// LookupAPIKey compares the key with all configured keys in constant time
+func (keys StaticAPIKeys) LookupAPIKey(ctx *Context, key string) (string, error) {
+	hash := sha256.Sum256([]byte(key))
+	for name, k := range keys {
+		h := sha256.Sum256([]byte(k))
+		if subtle.ConstantTimeCompare(hash[:], h[:]) == 1 {
+			return name, nil
+		}
+	}
+	return "", ErrInvalidCredentials
+}
+
+// StoredAPIKey is the gorm entity of DB backed API keys. Only the SHA-256 hash of the
+// key is stored (see HashAPIKey). Add it to the migrations to create the table.
+type StoredAPIKey struct {
+	ID        uint   `gorm:"primaryKey"`
+	Name      string `gorm:"size:255"`
+	KeyHash   string `gorm:"size:64;uniqueIndex"`
+	CreatedAt time.Time
+	ExpiresAt *time.Time
+	Revoked   bool
+}
+
+// HashAPIKey returns the hex encoded SHA-256 hash under which a key is stored
+func HashAPIKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// DBAPIKeys looks up keys in the StoredAPIKey table of the repository
+type DBAPIKeys struct {
+	Repository *Repository
+}
+
+// LookupAPIKey finds the key by its hash. Revoked and expired keys are rejected.
+func (d DBAPIKeys) LookupAPIKey(ctx *Context, key string) (string, error) {
+	stored := StoredAPIKey{}
+	res := d.Repository.WithContext(ctx.TraceContext()).Where("key_hash = ?", HashAPIKey(key)).First(&stored)
+	if res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			return "", ErrInvalidCredentials
+		}
+		return "", fmt.Errorf("error looking up api key: %w", res.Error)
+	}
+	if stored.Revoked {
+		return "", fmt.Errorf("%w: api key %s is revoked", ErrInvalidCredentials, stored.Name)
+	}
+	if stored.ExpiresAt != nil && stored.ExpiresAt.Before(time.Now()) {
+		return "", fmt.Errorf("%w: api key %s expired at %s", ErrInvalidCredentials, stored.Name, stored.ExpiresAt)
+	}
+	return stored.Name, nil
+}
+
+// GetAPIKeyAuthFromHeader authenticates requests carrying a valid API key in the given header
+func GetAPIKeyAuthFromHeader(header string, lookup APIKeyLookup) AuthFunc {
+	return getAPIKeyAuth(lookup, func(r *http.Request) string {
+		return r.Header.Get(header)
+	})
+}
+
+// GetAPIKeyAuthFromQuery authenticates requests carrying a valid API key in the given query parameter
+func GetAPIKeyAuthFromQuery(parameterName string, lookup APIKeyLookup) AuthFunc {
+	return getAPIKeyAuth(lookup, func(r *http.Request) string {
+		return r.URL.Query().Get(parameterName)
+	})
+}
+
+func getAPIKeyAuth(lookup APIKeyLookup, extractor func(r *http.Request) string) AuthFunc {
+	return func(ctx *Context) error {
+		key := extractor(ctx.Request)
+		if key == "" {
+			return fmt.Errorf("%w: no api key", ErrMissingCredentials)
+		}
+		name, err := lookup.LookupAPIKey(ctx, key)
+		if err != nil {
+			return fmt.Errorf("api key authentication failed: %w", err)
+		}
+		ctx.SetPrincipal(&Principal{Subject: name, AuthMethod: AuthMethodAPIKey})
+		return nil
+	}
+}
+
+// PasswordHashLookup returns the bcrypt hash of the password of the given user
+type PasswordHashLookup interface {
+	LookupPasswordHash(ctx *Context, user string) (hash string, err error)
+}
+
+// BasicAuthUsers maps user names to bcrypt hashes of their passwords
+type BasicAuthUsers map[string]string
+
+// LookupPasswordHash returns the hash of the user or ErrInvalidCredentials
+func (users BasicAuthUsers) LookupPasswordHash(ctx *Context, user string) (string, error) {
+	hash, ok := users[user]
+	if !ok {
+		return "", ErrInvalidCredentials
+	}
+	return hash, nil
+}
+
+// used to spend the same time on unknown users as on known ones
+var (
+	dummyBcryptHashOnce sync.Once
+	dummyBcryptHash     []byte
+	dummyBcryptHashErr  error
+)
+
+// getDummyBcryptHash creates the dummy hash on first use, so only servers using basic
+// auth pay for it
+func getDummyBcryptHash() ([]byte, error) {
+	dummyBcryptHashOnce.Do(func() {
+		dummyBcryptHash, dummyBcryptHashErr = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+	})
+	return dummyBcryptHash, dummyBcryptHashErr
+}
+
+// AuthChallengeError makes a failed authentication send a WWW-Authenticate header with
+// the given challenge. The header is only sent if the request is rejected, so a failing
+// auth function within AnyOf doesn't add it to the response of a succeeding one.
+type AuthChallengeError struct {
+	Challenge string
+	Err       error
+}
+
+func (e AuthChallengeError) Error() string {
+	return e.Err.Error()
+}
+
+func (e AuthChallengeError) Unwrap() error {
+	return e.Err
+}
+
+// sendAuthChallenges sets the WWW-Authenticate headers of all AuthChallengeErrors in err
+func sendAuthChallenges(ctx *Context, err error) {
+	if ctx.responseWriter == nil {
+		return
+	}
+	var walk func(err error)
+	walk = func(err error) {
+		switch e := err.(type) {
+		case AuthChallengeError:
+			ctx.responseWriter.Header().Add("WWW-Authenticate", e.Challenge)
+			walk(e.Err)
+		case interface{ Unwrap() []error }:
+			for _, inner := range e.Unwrap() {
+				walk(inner)
+			}
+		case interface{ Unwrap() error }:
+			walk(e.Unwrap())
+		}
+	}
+	walk(err)
+}
+
+// GetBasicAuth authenticates requests with HTTP Basic auth. Rejected requests get a
+// WWW-Authenticate header with the given realm.
+func GetBasicAuth(realm string, lookup PasswordHashLookup) AuthFunc {
+	challenge := func(err error) error {
+		return AuthChallengeError{Challenge: fmt.Sprintf("Basic realm=%q", realm), Err: err}
+	}
+	return func(ctx *Context) error {
+		user, password, ok := ctx.Request.BasicAuth()
+		if !ok {
+			return challenge(fmt.Errorf("%w: no basic auth header", ErrMissingCredentials))
+		}
+		hash, err := lookup.LookupPasswordHash(ctx, user)
+		if err != nil {
+			dummy, hashErr := getDummyBcryptHash()
+			if hashErr != nil {
+				ctx.LogErrorf("Error creating the dummy password hash: %s", hashErr)
+			} else {
+				bcrypt.CompareHashAndPassword(dummy, []byte(password))
+			}
+			return challenge(fmt.Errorf("basic authentication of user %s failed: %w", user, err))
+		}
+		err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if err != nil {
+			return challenge(fmt.Errorf("%w: wrong password for user %s", ErrInvalidCredentials, user))
+		}
+		ctx.SetPrincipal(&Principal{Subject: user, AuthMethod: AuthMethodBasic})
+		return nil
+	}
+}
+
+// HMACSecretLookup returns the shared secret of the given key id
+type HMACSecretLookup interface {
+	LookupHMACSecret(ctx *Context, keyID string) (secret string, err error)
+}
+
+// StaticHMACSecrets maps key ids to shared secrets
+type StaticHMACSecrets map[string]string
+
+// LookupHMACSecret returns the secret of the key id or ErrInvalidCredentials
+func (secrets StaticHMACSecrets) LookupHMACSecret(ctx *Context, keyID string) (string, error) {
+	secret, ok := secrets[keyID]
+	if !ok {
+		return "", ErrInvalidCredentials
+	}
+	return secret, nil
+}
+
+// NonceStore remembers the nonces of signed requests to detect replays. Implement it
+// on top of a shared store if several instances of the server are running.
+type NonceStore interface {
+	// CheckAndStore returns false if the nonce has been seen before. Otherwise the nonce
+	// is stored until the given expiry.
+	CheckAndStore(ctx context.Context, nonce string, expiry time.Time) (bool, error)
+}
+
+// MemoryNonceStore keeps nonces in memory
+type MemoryNonceStore struct {
+	mutex     sync.Mutex
+	nonces    map[string]time.Time
+	lastSweep time.Time
+}
+
+const nonceSweepInterval = time.Minute
+
+// CheckAndStore implements NonceStore. Expired nonces are removed regularly.
+func (m *MemoryNonceStore) CheckAndStore(ctx context.Context, nonce string, expiry time.Time) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.nonces == nil {
+		m.nonces = make(map[string]time.Time)
+	}
+	now := time.Now()
+	m.sweep(now)
+	if exp, seen := m.nonces[nonce]; seen && !exp.Before(now) {
+		return false, nil
+	}
+	m.nonces[nonce] = expiry
+	return true, nil
+}
+
+// sweep removes expired nonces. Must be called holding the mutex.
+func (m *MemoryNonceStore) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < nonceSweepInterval {
+		return
+	}
+	m.lastSweep = now
+	for n, exp := range m.nonces {
+		if exp.Before(now) {
+			delete(m.nonces, n)
+		}
+	}
+}
+
+// HMACOptions customizes GetHMACAuth
+type HMACOptions struct {
+	MaxSkew    time.Duration // maximum age of the timestamp (default 5m)
+	NonceStore NonceStore    // default: MemoryNonceStore
+}
+
+// GetHMACAuth authenticates requests signed with SignRequest. The signature covers the
+// method, the URI, the timestamp, the nonce and the body. Requests with a timestamp
+// deviating more than MaxSkew from now and requests reusing a nonce are rejected.
+func GetHMACAuth(lookup HMACSecretLookup, opts HMACOptions) AuthFunc {
+	if opts.MaxSkew == 0 {
+		opts.MaxSkew = defaultHMACMaxSkew
+	}
+	if opts.NonceStore == nil {
+		opts.NonceStore = &MemoryNonceStore{}
+	}
+	return func(ctx *Context) error {
+		r := ctx.Request
+		keyID := r.Header.Get(HeaderHMACKeyID)
+		ts := r.Header.Get(HeaderHMACTimestamp)
+		nonce := r.Header.Get(HeaderHMACNonce)
+		signature := r.Header.Get(HeaderHMACSignature)
+		if keyID == "" || ts == "" || nonce == "" || signature == "" {
+			return fmt.Errorf("%w: request is not signed", ErrMissingCredentials)
+		}
+
+		unix, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: invalid timestamp %s", ErrInvalidCredentials, ts)
+		}
+		timestamp := time.Unix(unix, 0)
+		if skew := time.Since(timestamp).Abs(); skew > opts.MaxSkew {
+			return fmt.Errorf("%w: timestamp %s is outside of the allowed skew of %s", ErrInvalidCredentials, timestamp, opts.MaxSkew)
+		}
+
+		secret, err := lookup.LookupHMACSecret(ctx, keyID)
+		if err != nil {
+			return fmt.Errorf("hmac authentication with key %s failed: %w", keyID, err)
+		}
+		body, err := ctx.GetRequestBody()
+		if err != nil {
+			return err
+		}
+		// controllers reading the body directly must still get it
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		expected := computeHMACSignature(secret, r.Method, r.RequestURI, ts, nonce, body)
+		if !hmac.Equal([]byte(expected), []byte(signature)) {
+			return fmt.Errorf("%w: signature mismatch for key %s", ErrInvalidCredentials, keyID)
+		}
+
+		// only valid signatures may consume a nonce
+		fresh, err := opts.NonceStore.CheckAndStore(r.Context(), keyID+":"+nonce, timestamp.Add(opts.MaxSkew))
+		if err != nil {
+			return fmt.Errorf("error checking nonce: %w", err)
+		}
+		if !fresh {
+			return fmt.Errorf("%w: nonce %s has been used before", ErrInvalidCredentials, nonce)
+		}
+		ctx.SetPrincipal(&Principal{Subject: keyID, AuthMethod: AuthMethodHMAC})
+		return nil
+	}
+}
+
+// SignRequest adds the headers verified by GetHMACAuth. It must be called after the
+// body has been set and reads it, so the body is replaced with an identical copy.
+func SignRequest(r *http.Request, keyID string, secret string) error {
+	body := []byte{}
+	if r.Body != nil {
+		var err error
+		body, err = io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return fmt.Errorf("error reading body of request to sign: %w", err)
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := uuid.New().String()
+	r.Header.Set(HeaderHMACKeyID, keyID)
+	r.Header.Set(HeaderHMACTimestamp, ts)
+	r.Header.Set(HeaderHMACNonce, nonce)
+	r.Header.Set(HeaderHMACSignature, computeHMACSignature(secret, r.Method, r.URL.RequestURI(), ts, nonce, body))
+	return nil
+}
+
+func computeHMACSignature(secret string, method string, uri string, ts string, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s", method, uri, ts, nonce, hex.EncodeToString(bodyHash[:]))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,443 @@
+package server
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// Struct tags evaluated by Bind
+const (
+	TagQuery    = "query"
+	TagPath     = "path"
+	TagHeader   = "header"
+	TagValidate = "validate"
+)
+
+// FieldError describes why a single field couldn't be bound or failed validation.
+// A list of them is sent as details of a 400 JSONErrorResponse.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+var (
+	ruleCache    sync.Map // parsed rules by validate tag
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
+// Bind creates a T and populates it from the request:
+//   - the JSON body is unmarshalled into it (if there is one)
+//   - fields tagged with `query:"name"` are set from query parameters
+//   - fields tagged with `path:"name"` are set from the gorilla/mux path variables
+//   - fields tagged with `header:"Name"` are set from request headers
+//
+// Afterwards the validation rules of all `validate` tags are checked (see Validate).
+// Any failure results in a 400 JSONErrorResponse listing the offending fields, so the
+// error can be passed straight to ctx.SendJsonError.
+func Bind[T any](ctx *Context) (T, error) {
+	var target T
+	err := ctx.BindInto(&target)
+	return target, err
+}
+
+// BindInto is the non-generic version of Bind. target must be a pointer to a struct.
+func (ctx *Context) BindInto(target any) error {
+	rv := reflect.ValueOf(target)
+	if rv.Kind() != reflect.Pointer || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("bind target must be a pointer to a struct but is %T", target)
+	}
+
+	body, err := ctx.GetRequestBody()
+	if err != nil {
+		return err
+	}
+	if len(strings.TrimSpace(string(body))) > 0 {
+		err = json.Unmarshal(body, target)
+		if err != nil {
+			return newBindError("invalid_request_body", []FieldError{{Field: "body", Message: err.Error()}})
+		}
+	}
+
+	fieldErrs := ctx.bindRequestValues(rv.Elem())
+	if len(fieldErrs) > 0 {
+		return newBindError("invalid_request_parameters", fieldErrs)
+	}
+	return Validate(target)
+}
+
+// Validate checks the rules declared with `validate` tags on the fields of v, which must
+// be a struct or a pointer to one. Rules are separated by commas:
+//   - required: the field must not have its zero value
+//   - min=N, max=N: bounds of numbers or the length of strings, slices and maps
+//   - enum=a|b|c: the value must be one of the listed ones
+//   - regex=pattern: strings must match the pattern. Must be the last rule as the pattern may contain commas.
+//
+// Except for required, rules are skipped for absent values: nil pointers, slices and maps
+// and empty strings. Other zero values like 0 are checked, so optional numbers must be
+// pointers. Nested structs are validated as well. Malformed tags result in an error
+// instead of a 400 JSONErrorResponse.
+func Validate(v any) error {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Pointer {
+		if rv.IsNil() {
+			return nil
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return fmt.Errorf("only structs can be validated but got %T", v)
+	}
+	fieldErrs, err := validateStruct(rv, "")
+	if err != nil {
+		return err
+	}
+	if len(fieldErrs) > 0 {
+		return newBindError("validation_failed", fieldErrs)
+	}
+	return nil
+}
+
+func newBindError(message string, fieldErrs []FieldError) JSONErrorResponse {
+	msgs := make([]string, 0, len(fieldErrs))
+	for _, fe := range fieldErrs {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", fe.Field, fe.Message))
+	}
+	return JSONErrorResponse{
+		Code:       http.StatusBadRequest,
+		Message:    message,
+		LogMessage: fmt.Sprintf("%s: %s", message, strings.Join(msgs, "; ")),
+		Details:    fieldErrs,
+	}
+}
+
+// bindRequestValues sets all fields tagged with query, path or header
+func (ctx *Context) bindRequestValues(rv reflect.Value) []FieldError {
+	fieldErrs := []FieldError{}
+	query := ctx.Request.URL.Query()
+	vars := mux.Vars(ctx.Request)
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		sf := rt.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		fv := rv.Field(i)
+		if sf.Anonymous && sf.Type.Kind() == reflect.Struct {
+			fieldErrs = append(fieldErrs, ctx.bindRequestValues(fv)...)
+			continue
+		}
+
+		var name string
+		var values []string
+		if name = sf.Tag.Get(TagQuery); name != "" {
+			values = query[name]
+		} else if name = sf.Tag.Get(TagPath); name != "" {
+			if v, ok := vars[name]; ok {
+				values = []string{v}
+			}
+		} else if name = sf.Tag.Get(TagHeader); name != "" {
+			values = ctx.Request.Header.Values(name)
+		}
+		if len(values) == 0 {
+			continue
+		}
+		err := setFieldFromStrings(fv, values)
+		if err != nil {
+			fieldErrs = append(fieldErrs, FieldError{Field: name, Message: err.Error()})
+		}
+	}
+	return fieldErrs
+}
+
+func setFieldFromStrings(fv reflect.Value, values []string) error {
+	if fv.Kind() == reflect.Pointer {
+		if fv.IsNil() {
+			fv.Set(reflect.New(fv.Type().Elem()))
+		}
+		return setFieldFromStrings(fv.Elem(), values)
+	}
+	if fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() != reflect.Uint8 && !isTextUnmarshaler(fv) {
+		slice := reflect.MakeSlice(fv.Type(), len(values), len(values))
+		for i, value := range values {
+			err := setFieldFromString(slice.Index(i), value)
+			if err != nil {
+				return err
+			}
+		}
+		fv.Set(slice)
+		return nil
+	}
+	return setFieldFromString(fv, values[0])
+}
+
+func setFieldFromString(fv reflect.Value, value string) error {
+	if fv.Kind() == reflect.Pointer {
+		if fv.IsNil() {
+			fv.Set(reflect.New(fv.Type().Elem()))
+		}
+		return setFieldFromString(fv.Elem(), value)
+	}
+	if u, ok := fv.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(value))
+	}
+	if fv.Type() == durationType {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration: %s", value)
+		}
+		fv.SetInt(int64(d))
+		return nil
+	}
+	switch fv.Kind() {
+	case reflect.String:
+		fv.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean: %s", value)
+		}
+		fv.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(value, 10, fv.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid integer: %s", value)
+		}
+		fv.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(value, 10, fv.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid unsigned integer: %s", value)
+		}
+		fv.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, fv.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid number: %s", value)
+		}
+		fv.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported field type %s", fv.Type())
+	}
+	return nil
+}
+
+func isTextUnmarshaler(fv reflect.Value) bool {
+	_, ok := fv.Addr().Interface().(encoding.TextUnmarshaler)
+	return ok
+}
+
+func validateStruct(rv reflect.Value, prefix string) ([]FieldError, error) {
+	fieldErrs := []FieldError{}
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		sf := rt.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		fv := rv.Field(i)
+		name := prefix + fieldName(sf)
+
+		tag := sf.Tag.Get(TagValidate)
+		if tag != "" && tag != "-" {
+			rules, err := getRules(tag)
+			if err != nil {
+				return nil, fmt.Errorf("invalid validate tag of field %s of %s: %w", sf.Name, rt, err)
+			}
+			msg := validateField(fv, rules)
+			if msg != "" {
+				fieldErrs = append(fieldErrs, FieldError{Field: name, Message: msg})
+				continue
+			}
+		}
+
+		// nested structs
+		for fv.Kind() == reflect.Pointer && !fv.IsNil() {
+			fv = fv.Elem()
+		}
+		if fv.Kind() == reflect.Struct && fv.Type() != reflect.TypeOf(time.Time{}) {
+			nestedPrefix := name + "."
+			if sf.Anonymous {
+				nestedPrefix = prefix
+			}
+			nestedErrs, err := validateStruct(fv, nestedPrefix)
+			if err != nil {
+				return nil, err
+			}
+			fieldErrs = append(fieldErrs, nestedErrs...)
+		}
+	}
+	return fieldErrs, nil
+}
+
+// fieldName returns the name under which the field is known to the client
+func fieldName(sf reflect.StructField) string {
+	for _, tag := range []string{"json", TagQuery, TagPath, TagHeader} {
+		name, _, _ := strings.Cut(sf.Tag.Get(tag), ",")
+		if name != "" && name != "-" {
+			return name
+		}
+	}
+	return sf.Name
+}
+
+// validationRule is a parsed rule of a validate tag
+type validationRule struct {
+	name    string
+	param   string
+	limit   float64        // min, max
+	allowed []string       // enum
+	regex   *regexp.Regexp // regex
+}
+
+// parsedRules caches the result of parsing a validate tag, including the error
+type parsedRules struct {
+	rules []validationRule
+	err   error
+}
+
+// getRules parses the rules of a validate tag once and caches them
+func getRules(tag string) ([]validationRule, error) {
+	cached, ok := ruleCache.Load(tag)
+	if !ok {
+		rules, err := parseRules(tag)
+		cached, _ = ruleCache.LoadOrStore(tag, parsedRules{rules: rules, err: err})
+	}
+	parsed := cached.(parsedRules)
+	return parsed.rules, parsed.err
+}
+
+func parseRules(tag string) ([]validationRule, error) {
+	rules := []validationRule{}
+	for _, rule := range splitRules(tag) {
+		name, param, _ := strings.Cut(rule, "=")
+		r := validationRule{name: name, param: param}
+		switch name {
+		case "required":
+		case "min", "max":
+			limit, err := strconv.ParseFloat(param, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s rule: %s", name, rule)
+			}
+			r.limit = limit
+		case "enum":
+			r.allowed = strings.Split(param, "|")
+		case "regex":
+			re, err := regexp.Compile(param)
+			if err != nil {
+				return nil, fmt.Errorf("invalid regex rule: %w", err)
+			}
+			r.regex = re
+		default:
+			return nil, fmt.Errorf("unknown validation rule: %s", rule)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// validateField returns a message describing the first violated rule or an empty string
+func validateField(fv reflect.Value, rules []validationRule) string {
+	if fv.IsZero() {
+		for _, rule := range rules {
+			if rule.name == "required" {
+				return "is required"
+			}
+		}
+	}
+	if isAbsent(fv) {
+		return ""
+	}
+	for fv.Kind() == reflect.Pointer {
+		fv = fv.Elem()
+	}
+
+	for _, rule := range rules {
+		switch rule.name {
+		case "min", "max":
+			value, isLength, ok := measure(fv)
+			if !ok {
+				continue
+			}
+			if rule.name == "min" && value < rule.limit {
+				if isLength {
+					return fmt.Sprintf("must have a length of at least %s", rule.param)
+				}
+				return fmt.Sprintf("must be at least %s", rule.param)
+			}
+			if rule.name == "max" && value > rule.limit {
+				if isLength {
+					return fmt.Sprintf("must have a length of at most %s", rule.param)
+				}
+				return fmt.Sprintf("must be at most %s", rule.param)
+			}
+		case "enum":
+			if !slices.Contains(rule.allowed, fmt.Sprint(fv.Interface())) {
+				return fmt.Sprintf("must be one of %s", strings.Join(rule.allowed, ", "))
+			}
+		case "regex":
+			if fv.Kind() != reflect.String {
+				continue
+			}
+			if !rule.regex.MatchString(fv.String()) {
+				return fmt.Sprintf("must match %s", rule.param)
+			}
+		}
+	}
+	return ""
+}
+
+// isAbsent reports whether the value wasn't set at all, in contrast to being set to a zero value
+func isAbsent(fv reflect.Value) bool {
+	switch fv.Kind() {
+	case reflect.Pointer, reflect.Slice, reflect.Map, reflect.Interface:
+		return fv.IsNil()
+	case reflect.String:
+		return fv.Len() == 0
+	}
+	return false
+}
+
+// splitRules splits the rules at commas except for regex, which must come last
+func splitRules(rules string) []string {
+	before, regex, hasRegex := strings.Cut(rules, "regex=")
+	result := []string{}
+	for _, rule := range strings.Split(before, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule != "" {
+			result = append(result, rule)
+		}
+	}
+	if hasRegex {
+		result = append(result, "regex="+regex)
+	}
+	return result
+}
+
+// measure returns the value of numbers or the length of strings, slices and maps
+func measure(fv reflect.Value) (value float64, isLength bool, ok bool) {
+	switch fv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(fv.Int()), false, true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(fv.Uint()), false, true
+	case reflect.Float32, reflect.Float64:
+		return fv.Float(), false, true
+	case reflect.String:
+		return float64(utf8.RuneCountInString(fv.String())), true, true
+	case reflect.Slice, reflect.Map, reflect.Array:
+		return float64(fv.Len()), true, true
+	}
+	return 0, false, false
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// ConfigMaxRequestBodySize limits the size of request bodies in bytes. Larger requests are
+// answered with 413. Unlimited if not set. See Controller.MaxRequestBodySize.
+const ConfigMaxRequestBodySize = "max_request_body_size"
+
+// maxRequestBodySize returns the limit of the controller, 0 meaning unlimited
+func (s *Server) maxRequestBodySize(c *Controller) int64 {
+	if c.MaxRequestBodySize < 0 {
+		return 0
+	}
+	if c.MaxRequestBodySize > 0 {
+		return c.MaxRequestBodySize
+	}
+	return s.maxBodySize
+}
+
+func loadMaxRequestBodySize(config Config) (int64, error) {
+	value := config.Get(ConfigMaxRequestBodySize)
+	if value == "" {
+		return 0, nil
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid %s: %s, must be a number of bytes", ConfigMaxRequestBodySize, value)
+	}
+	return size, nil
+}
+
+// limitRequestBody rejects requests announcing a body above the limit and makes reading
+// fail once the limit is exceeded. Returns false if the request must not be processed further.
+func (s *Server) limitRequestBody(ctx *Context, w http.ResponseWriter) bool {
+	limit := s.maxRequestBodySize(ctx.Controller)
+	if limit == 0 || ctx.Request.Body == nil || ctx.Request.Body == http.NoBody {
+		return true
+	}
+	if ctx.Request.ContentLength > limit {
+		ctx.SendJsonError(requestBodyTooLarge(limit))
+		return false
+	}
+	ctx.Request.Body = http.MaxBytesReader(w, ctx.Request.Body, limit)
+	return true
+}
+
+func requestBodyTooLarge(limit int64) JSONErrorResponse {
+	return JSONErrorResponse{
+		Code:       http.StatusRequestEntityTooLarge,
+		Message:    "request_body_too_large",
+		LogMessage: fmt.Sprintf("request body exceeds the limit of %d bytes", limit),
+	}
+}
+
+// RequestBodyReader returns the body for reading it piece by piece, e.g. to pass uploads on
+// to a storage without holding them in memory. Reads beyond the max request body size fail
+// with a 413 JSONErrorResponse. If the body was read with GetRequestBody already, a reader
+// on the buffered body is returned.
+func (ctx *Context) RequestBodyReader() io.ReadCloser {
+	if len(ctx.requestBody) > 0 {
+		return io.NopCloser(bytes.NewReader(ctx.requestBody))
+	}
+	if ctx.Request.Body == nil {
+		return http.NoBody
+	}
+	return limitedBody{ctx.Request.Body}
+}
+
+// limitedBody turns exceeding the body limit into a 413 JSONErrorResponse
+type limitedBody struct {
+	io.ReadCloser
+}
+
+func (b limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		err = requestBodyTooLarge(maxErr.Limit)
+	}
+	return n, err
+}
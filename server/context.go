@@ -5,17 +5,35 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
 )
 
 const (
+	LogLevelTrace       = "trace"
 	LogLevelDebug       = "debug"
 	LogLevelInfo        = "info"
+	LogLevelWarn        = "warn"
+	LogLevelError       = "error"
 	ContextKeyRequestID = "request_id"
 )
 
+// ConfigTrustProxyHeaders makes ClientIP use the X-Forwarded-For and X-Real-IP headers.
+// Only enable it behind a proxy setting them, otherwise clients can spoof their IP.
+const ConfigTrustProxyHeaders = "trust_proxy_headers"
+
+// ConfigTrustedProxyHops is the number of proxies in front of the server appending to
+// X-Forwarded-For (default 1). The client IP is taken this many entries from the right,
+// as entries further left are passed through from the client unchecked.
+const ConfigTrustedProxyHops = "trusted_proxy_hops"
+
 // Context intantiated for every request
 type Context struct {
 	Server             *Server
@@ -26,11 +44,15 @@ type Context struct {
 	ResponseCode       int
 	StatusInformation  *StatusInformation
 	requestBody        []byte
-	Subdomain          string
-	serviceMap         map[string]interface{}
+	Subdomain          string // subdomain of the request in front of one of the base domains (see ConfigBaseDomains)
 	ControllerProvider ControllerProvider
 	Controller         *Controller
-	LogLevel           string
+	Route              string // path template of the route, e.g. /users/{id}
+	logger             *slog.Logger
+	principal          *Principal
+	tenant             any
+	tenantResolved     bool
+	stream             *SSEStream
 }
 
 // JSONErrorResponse General format of error responses
@@ -39,6 +61,7 @@ type JSONErrorResponse struct {
 	Message    string `json:"message"`
 	LogMessage string `json:"-"`
 	RequestID  string `json:"request_id"`
+	Details    any    `json:"details,omitempty"` // optional, e.g. the list of FieldErrors of Bind
 }
 
 func (jer JSONErrorResponse) Error() string {
@@ -59,19 +82,22 @@ func ErrToJSONErrorResponsePreserveCode(err error, message string) JSONErrorResp
 	return jerr
 }
 
-// GetService retrieves the specified service by name
+// GetService retrieves the specified service by name. Returns nil if there is no
+// such service. Prefer the type safe Resolve function.
 func (ctx *Context) GetService(name string) interface{} {
-	service, ok := ctx.serviceMap[name]
-	if ok {
-		return service
+	service, err := ctx.Server.getServiceRegistry().resolve(name, ctx.Server)
+	if err != nil {
+		ctx.LogError(err.Error())
+		return nil
 	}
-	return fmt.Errorf("No service with name %s found", name)
+	return service
 }
 
-// GetRequestBody readx the full body and returns it
+// GetRequestBody readx the full body and returns it. Bodies exceeding the max request
+// body size result in a 413 JSONErrorResponse. Use RequestBodyReader for large uploads.
 func (ctx *Context) GetRequestBody() ([]byte, error) {
 	if len(ctx.requestBody) == 0 {
-		body, err := ioutil.ReadAll(ctx.Request.Body)
+		body, err := io.ReadAll(limitedBody{ctx.Request.Body})
 		defer ctx.Request.Body.Close()
 		if err != nil {
 			return nil, fmt.Errorf("Error while reading request body: %w", err)
@@ -81,6 +107,88 @@ func (ctx *Context) GetRequestBody() ([]byte, error) {
 	return ctx.requestBody, nil
 }
 
+// PathParam returns the value of the given path variable, e.g. id for the route /users/{id}.
+// Returns an empty string if the route has no such variable.
+func (ctx *Context) PathParam(name string) string {
+	return mux.Vars(ctx.Request)[name]
+}
+
+// PathParamInt returns the given path variable parsed as int. If it is missing or not
+// a valid integer, a 400 JSONErrorResponse is returned that can be sent with SendJsonError.
+func (ctx *Context) PathParamInt(name string) (int, error) {
+	value := ctx.PathParam(name)
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, invalidPathParamError(name, value, "an integer")
+	}
+	return i, nil
+}
+
+// PathParamUUID returns the given path variable parsed as UUID. If it is missing or not
+// a valid UUID, a 400 JSONErrorResponse is returned that can be sent with SendJsonError.
+func (ctx *Context) PathParamUUID(name string) (uuid.UUID, error) {
+	value := ctx.PathParam(name)
+	id, err := uuid.Parse(value)
+	if err != nil {
+		return uuid.Nil, invalidPathParamError(name, value, "a uuid")
+	}
+	return id, nil
+}
+
+func invalidPathParamError(name string, value string, expected string) JSONErrorResponse {
+	return JSONErrorResponse{
+		Code:       http.StatusBadRequest,
+		Message:    fmt.Sprintf("invalid_path_parameter: %s", name),
+		LogMessage: fmt.Sprintf("path parameter %s is expected to be %s but is: '%s'", name, expected, value),
+		Details:    []FieldError{{Field: name, Message: fmt.Sprintf("must be %s", expected)}},
+	}
+}
+
+// ClientIP returns the IP of the client. With trust_proxy_headers=true the address added
+// by the outermost trusted proxy to X-Forwarded-For (see ConfigTrustedProxyHops) or
+// X-Real-IP is used if present, otherwise the remote address.
+func (ctx *Context) ClientIP() string {
+	if ctx.Server.trustProxyHeaders {
+		if forwarded := ctx.Server.forwardedValue(ctx.Request, "X-Forwarded-For"); forwarded != "" {
+			return forwarded
+		}
+		if realIP := ctx.Request.Header.Get("X-Real-IP"); realIP != "" {
+			return strings.TrimSpace(realIP)
+		}
+	}
+	host, _, err := net.SplitHostPort(ctx.Request.RemoteAddr)
+	if err != nil {
+		return ctx.Request.RemoteAddr
+	}
+	return host
+}
+
+// forwardedValue returns the entry of a comma separated forwarding header added by the
+// outermost trusted proxy. If there are less entries, the leftmost one is returned.
+func (s *Server) forwardedValue(r *http.Request, header string) string {
+	entries := []string{}
+	for _, value := range r.Header.Values(header) {
+		entries = append(entries, strings.Split(value, ",")...)
+	}
+	if len(entries) == 0 {
+		return ""
+	}
+	hops := max(s.proxyHops, 1)
+	return strings.TrimSpace(entries[max(len(entries)-hops, 0)])
+}
+
+func loadProxyHops(config Config) (int, error) {
+	value := config.Get(ConfigTrustedProxyHops)
+	if value == "" {
+		return 1, nil
+	}
+	hops, err := strconv.Atoi(value)
+	if err != nil || hops < 1 {
+		return 0, fmt.Errorf("invalid %s: %s, must be a positive number", ConfigTrustedProxyHops, value)
+	}
+	return hops, nil
+}
+
 // GetResponseWriter returns the response writer if it was set
 func (ctx *Context) GetResponseWriter() http.ResponseWriter {
 	if ctx.responseWriter == nil {
@@ -156,13 +264,29 @@ func (ctx *Context) SendJsonError(err error) {
 	ctx.SendJSONResponse(jerr.Code, content)
 }
 
-func (ctx *Context) log(severity string, msg string) {
-	log.Printf(`{"req_id": "%s", "severity": "%s", "controller": "%s"} %s`, ctx.GetRequestID(), severity, ctx.Controller.Name, msg)
+// Logger returns the logger of this request. It carries the request id, controller,
+// method and path as attributes. Controllers can derive loggers with additional
+// attributes using With or add them permanently to the context with AddLogAttrs.
+func (ctx *Context) Logger() *slog.Logger {
+	if ctx.logger == nil {
+		return ctx.Server.Logger()
+	}
+	return ctx.logger
+}
+
+// AddLogAttrs adds attributes to all messages subsequently logged through this context.
+// The arguments are handled the same way as by slog.Logger.With.
+func (ctx *Context) AddLogAttrs(args ...any) {
+	ctx.logger = ctx.Logger().With(args...)
+}
+
+func (ctx *Context) log(level slog.Level, msg string, args ...any) {
+	ctx.Logger().Log(ctx.Request.Context(), level, msg, args...)
 }
 
 // LogError logs an error
 func (ctx *Context) LogError(msg string) {
-	ctx.log("Error", msg)
+	ctx.log(slog.LevelError, msg)
 }
 
 // LogErrorf logs an error with formatting
@@ -171,9 +295,20 @@ func (ctx *Context) LogErrorf(format string, args ...any) {
 	ctx.LogError(msg)
 }
 
+// LogWarn logs a warning
+func (ctx *Context) LogWarn(msg string) {
+	ctx.log(slog.LevelWarn, msg)
+}
+
+// LogWarnf logs a warning with formatting
+func (ctx *Context) LogWarnf(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	ctx.LogWarn(msg)
+}
+
 // LogInfo logs an info message
 func (ctx *Context) LogInfo(msg string) {
-	ctx.log("Info", msg)
+	ctx.log(slog.LevelInfo, msg)
 }
 
 // LogInfof logs an info message with formatting
@@ -184,17 +319,26 @@ func (ctx *Context) LogInfof(format string, args ...any) {
 
 // LogDebug logs an debug message
 func (ctx *Context) LogDebug(msg string) {
-	if ctx.LogLevel == LogLevelDebug {
-		ctx.log("Debug", msg)
-	}
+	ctx.log(slog.LevelDebug, msg)
 }
 
-// LogInfof logs an debug message with formatting
+// LogDebugf logs an debug message with formatting
 func (ctx *Context) LogDebugf(format string, args ...any) {
 	msg := fmt.Sprintf(format, args...)
 	ctx.LogDebug(msg)
 }
 
+// LogTrace logs a trace message
+func (ctx *Context) LogTrace(msg string) {
+	ctx.log(LevelTrace, msg)
+}
+
+// LogTracef logs a trace message with formatting
+func (ctx *Context) LogTracef(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	ctx.LogTrace(msg)
+}
+
 func (ctx *Context) GetRequestContextValue(key string) any {
 	return ctx.Request.Context().Value(key)
 }
@@ -17,8 +17,16 @@ type Controller struct {
 	HandlesSubpaths    bool
 	Methods            []string
 	IsSecured          bool
-	AuthFunc           func(ctx *Context) error
+	AuthFunc           AuthFunc
+	RequiredScopes     []string // the principal needs all of them, otherwise 403 is returned
+	RequiredRoles      []string // the principal needs at least one of them, otherwise 403 is returned
 	ControllerFunc     func(ctx *Context)
+	WebSocketFunc      WebSocketFunc // upgrades GET requests to WebSocket connections instead of calling ControllerFunc
+	Middlewares        []Middleware  // executed after the global middlewares registered with Server.Use
+	CORS               *CORSOptions  // overrides the CORS config of the server. Empty options disable CORS for the controller
+	RateLimit          *RateLimit    // rejects requests exceeding the limit with 429
+	Subdomains         []string      // restricts the controller to these subdomains (see ConfigBaseDomains). Supports patterns like tenant-*
+	MaxRequestBodySize int64         // overrides max_request_body_size, negative values remove the limit
 	controllerProvider ControllerProvider
 	Description        string
 }
@@ -26,5 +34,9 @@ type Controller struct {
 // Execute executes the controller in the given context
 func (ctr *Controller) Execute(ctx *Context) {
 	ctx.StatusInformation.IncrementMetric(ctr.Metric)
+	if ctr.WebSocketFunc != nil {
+		ctx.serveWebSocket(ctr.WebSocketFunc)
+		return
+	}
 	ctr.ControllerFunc(ctx)
 }
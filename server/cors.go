@@ -0,0 +1,252 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Config properties of the CORS handling. Lists are comma separated. CORS is enabled
+// as soon as cors_allowed_origins is set.
+const (
+	// ConfigCORSAllowedOrigins lists the allowed origins. * allows any origin and
+	// https://*.example.com any subdomain of example.com
+	ConfigCORSAllowedOrigins = "cors_allowed_origins"
+	// ConfigCORSAllowedMethods defaults to the methods of the controller
+	ConfigCORSAllowedMethods = "cors_allowed_methods"
+	// ConfigCORSAllowedHeaders defaults to DefaultCORSAllowedHeaders. * allows any header
+	ConfigCORSAllowedHeaders = "cors_allowed_headers"
+	// ConfigCORSExposedHeaders defaults to X-Request-ID
+	ConfigCORSExposedHeaders   = "cors_exposed_headers"
+	ConfigCORSAllowCredentials = "cors_allow_credentials"
+	// ConfigCORSMaxAge is the duration browsers may cache preflight results, e.g. 10m
+	ConfigCORSMaxAge = "cors_max_age"
+)
+
+// DefaultCORSAllowedHeaders are the request headers allowed unless configured otherwise
+var DefaultCORSAllowedHeaders = []string{"Accept", "Authorization", "Content-Type", HeaderRequestID, "traceparent", "tracestate"}
+
+// CORSOptions configures cross-origin requests of the server (see ConfigCORSAllowedOrigins)
+// or of a single controller (see Controller.CORS). Without AllowedOrigins CORS is disabled.
+type CORSOptions struct {
+	AllowedOrigins   []string
+	AllowedMethods   []string // defaults to the methods of the controllers of the path
+	AllowedHeaders   []string // defaults to DefaultCORSAllowedHeaders
+	ExposedHeaders   []string // defaults to X-Request-ID
+	AllowCredentials bool
+	MaxAge           time.Duration
+}
+
+// preflightRoute answers preflight requests of a path. All controllers registered for
+// the path contribute their methods.
+type preflightRoute struct {
+	methods []string
+	cors    *CORSOptions
+}
+
+// loadCORSOptions reads the server wide CORS configuration. Returns nil if CORS isn't configured.
+func loadCORSOptions(config Config) (*CORSOptions, error) {
+	origins := splitConfigList(config.Get(ConfigCORSAllowedOrigins))
+	if len(origins) == 0 {
+		return nil, nil
+	}
+	maxAge, err := config.GetDuration(ConfigCORSMaxAge)
+	if err != nil {
+		return nil, err
+	}
+	cors := &CORSOptions{
+		AllowedOrigins:   origins,
+		AllowedMethods:   splitConfigList(config.Get(ConfigCORSAllowedMethods)),
+		AllowedHeaders:   splitConfigList(config.Get(ConfigCORSAllowedHeaders)),
+		ExposedHeaders:   splitConfigList(config.Get(ConfigCORSExposedHeaders)),
+		AllowCredentials: config.Get(ConfigCORSAllowCredentials) == "true",
+		MaxAge:           maxAge,
+	}
+	err = cors.validate()
+	if err != nil {
+		return nil, err
+	}
+	return cors, nil
+}
+
+// validate rejects credentials for any origin, as every website could then make
+// requests with the cookies of the user and read the responses
+func (cors *CORSOptions) validate() error {
+	if cors.AllowCredentials && slices.Contains(cors.AllowedOrigins, "*") {
+		return errors.New("CORS credentials can't be allowed for any origin (*), list the allowed origins instead")
+	}
+	return nil
+}
+
+func splitConfigList(value string) []string {
+	values := []string{}
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// getCORSOptions returns the options of the controller or those of the server. Returns
+// nil if CORS is disabled for the controller.
+func (s *Server) getCORSOptions(c *Controller) *CORSOptions {
+	cors := s.cors
+	if c.CORS != nil {
+		cors = c.CORS
+	}
+	if cors == nil || len(cors.AllowedOrigins) == 0 {
+		return nil
+	}
+	return cors
+}
+
+// registerPreflight registers an OPTIONS route for the path of the controller unless
+// the controller handles OPTIONS itself
+func (s *Server) registerPreflight(r *mux.Router, c Controller) {
+	cors := s.getCORSOptions(&c)
+	if cors == nil || slices.Contains(c.Methods, http.MethodOptions) {
+		return
+	}
+	if s.preflightRoutes == nil {
+		s.preflightRoutes = make(map[string]*preflightRoute)
+	}
+	route, exists := s.preflightRoutes[c.Path]
+	if exists {
+		route.methods = append(route.methods, c.Methods...)
+		return
+	}
+	route = &preflightRoute{methods: slices.Clone(c.Methods), cors: cors}
+	s.preflightRoutes[c.Path] = route
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.handlePreflight(w, r, route)
+	})
+	if c.HandlesSubpaths {
+		r.PathPrefix(c.Path).Handler(handler).Methods(http.MethodOptions)
+	} else {
+		r.Handle(c.Path, handler).Methods(http.MethodOptions)
+	}
+}
+
+// handlePreflight answers with 204 and the CORS headers if origin, method and headers
+// are allowed and with 403 otherwise. OPTIONS requests without Origin get the Allow header.
+func (s *Server) handlePreflight(w http.ResponseWriter, r *http.Request, route *preflightRoute) {
+	cors := route.cors
+	methods := cors.AllowedMethods
+	if len(methods) == 0 {
+		methods = route.methods
+	}
+	header := w.Header()
+	header.Add("Vary", "Origin")
+	header.Add("Vary", "Access-Control-Request-Method")
+	header.Add("Vary", "Access-Control-Request-Headers")
+
+	origin := r.Header.Get("Origin")
+	requestedMethod := r.Header.Get("Access-Control-Request-Method")
+	if origin == "" || requestedMethod == "" {
+		header.Set("Allow", strings.Join(append(slices.Clone(methods), http.MethodOptions), ", "))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	err := cors.checkPreflight(origin, requestedMethod, r.Header.Get("Access-Control-Request-Headers"), methods)
+	if err != nil {
+		s.Logger().Debug("Rejected CORS preflight", slog.String("path", r.URL.Path), slog.String("origin", origin), slog.String("error", err.Error()))
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	header.Set("Access-Control-Allow-Origin", cors.allowOriginValue(origin))
+	header.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	if requestedHeaders := r.Header.Get("Access-Control-Request-Headers"); requestedHeaders != "" {
+		header.Set("Access-Control-Allow-Headers", requestedHeaders)
+	}
+	if cors.AllowCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if cors.MaxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(int(cors.MaxAge.Seconds())))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cors *CORSOptions) checkPreflight(origin string, method string, requestedHeaders string, methods []string) error {
+	if !cors.isOriginAllowed(origin) {
+		return fmt.Errorf("origin %s not allowed", origin)
+	}
+	if !slices.Contains(methods, strings.ToUpper(method)) {
+		return fmt.Errorf("method %s not allowed", method)
+	}
+	allowed := cors.AllowedHeaders
+	if len(allowed) == 0 {
+		allowed = DefaultCORSAllowedHeaders
+	}
+	if slices.Contains(allowed, "*") {
+		return nil
+	}
+	for _, h := range splitConfigList(requestedHeaders) {
+		if !slices.ContainsFunc(allowed, func(a string) bool { return strings.EqualFold(a, h) }) {
+			return fmt.Errorf("header %s not allowed", h)
+		}
+	}
+	return nil
+}
+
+// isOriginAllowed matches the origin against the allowed origins. An allowed origin
+// https://*.example.com matches https://app.example.com and https://a.b.example.com
+// but not https://example.com.
+func (cors *CORSOptions) isOriginAllowed(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, allowed := range cors.AllowedOrigins {
+		allowed = strings.ToLower(allowed)
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+		scheme, domain, found := strings.Cut(allowed, "://*.")
+		if found && strings.HasPrefix(origin, scheme+"://") && strings.HasSuffix(origin, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowOriginValue returns the value of Access-Control-Allow-Origin for an allowed origin.
+// It's a literal * if any origin is allowed, otherwise the origin itself.
+func (cors *CORSOptions) allowOriginValue(origin string) string {
+	if slices.Contains(cors.AllowedOrigins, "*") {
+		return "*"
+	}
+	return origin
+}
+
+// setCORSHeaders adds the CORS headers to the response of an actual cross-origin request
+func (s *Server) setCORSHeaders(w http.ResponseWriter, r *http.Request, c *Controller) {
+	cors := s.getCORSOptions(c)
+	if cors == nil {
+		return
+	}
+	header := w.Header()
+	header.Add("Vary", "Origin")
+	origin := r.Header.Get("Origin")
+	if origin == "" || !cors.isOriginAllowed(origin) {
+		return
+	}
+	header.Set("Access-Control-Allow-Origin", cors.allowOriginValue(origin))
+	if cors.AllowCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+	exposed := cors.ExposedHeaders
+	if len(exposed) == 0 {
+		exposed = []string{HeaderRequestID}
+	}
+	header.Set("Access-Control-Expose-Headers", strings.Join(exposed, ", "))
+}
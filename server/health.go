@@ -0,0 +1,189 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ConfigHealthCheckTimeout is the maximum duration of a single health check (default 2s)
+const ConfigHealthCheckTimeout = "healthCheckTimeout"
+
+// Health states reported by the health endpoints
+const (
+	HealthStatusOK           = "ok"
+	HealthStatusFailed       = "failed"
+	HealthStatusUnavailable  = "unavailable"
+	HealthStatusShuttingDown = "shutting_down"
+)
+
+const (
+	defaultHealthCheckTimeout = 2 * time.Second
+)
+
+// HealthChecker is implemented by everything the readiness of the server depends on,
+// e.g. the Repository or a client of a downstream service.
+type HealthChecker interface {
+	CheckHealth(ctx context.Context) error
+}
+
+// HealthCheckFunc allows to use an ordinary function as HealthChecker
+type HealthCheckFunc func(ctx context.Context) error
+
+// CheckHealth calls f(ctx)
+func (f HealthCheckFunc) CheckHealth(ctx context.Context) error {
+	return f(ctx)
+}
+
+// HealthResponse is returned by the health endpoints
+type HealthResponse struct {
+	Status string                       `json:"status"`
+	Checks map[string]HealthCheckResult `json:"checks,omitempty"`
+}
+
+// HealthCheckResult is the outcome of a single health check
+type HealthCheckResult struct {
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+type healthCheck struct {
+	name    string
+	checker HealthChecker
+}
+
+// RegisterHealthCheck adds a check to the readiness endpoint. The repository is
+// registered automatically when set with SetRepository.
+func (s *Server) RegisterHealthCheck(name string, checker HealthChecker) {
+	s.healthChecks = append(s.healthChecks, healthCheck{name: name, checker: checker})
+}
+
+func loadHealthCheckTimeout(config Config) (time.Duration, error) {
+	timeout, err := config.GetDuration(ConfigHealthCheckTimeout)
+	if err != nil {
+		return 0, err
+	}
+	if timeout < 0 {
+		return 0, fmt.Errorf("invalid %s: %s, must not be negative", ConfigHealthCheckTimeout, timeout)
+	}
+	return timeout, nil
+}
+
+// CheckReadiness runs all registered health checks concurrently, each limited by the
+// configured timeout. The server is ready if all checks succeed and it's not shutting down.
+func (s *Server) CheckReadiness(ctx context.Context) HealthResponse {
+	timeout := s.healthCheckTimeout
+	if timeout == 0 {
+		timeout = defaultHealthCheckTimeout
+	}
+
+	results := make(map[string]HealthCheckResult)
+	mutex := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for _, hc := range s.healthChecks {
+		wg.Add(1)
+		go func(hc healthCheck) {
+			defer wg.Done()
+			result := runHealthCheck(ctx, hc.checker, timeout)
+			mutex.Lock()
+			defer mutex.Unlock()
+			results[hc.name] = result
+		}(hc)
+	}
+	wg.Wait()
+
+	response := HealthResponse{
+		Status: HealthStatusOK,
+		Checks: results,
+	}
+	for _, result := range results {
+		if result.Status != HealthStatusOK {
+			response.Status = HealthStatusUnavailable
+		}
+	}
+	if s.shuttingDown.Load() {
+		response.Status = HealthStatusShuttingDown
+	}
+	return response
+}
+
+// runHealthCheck enforces the timeout even if the checker ignores the context. A panicking
+// checker is reported as failed.
+func runHealthCheck(ctx context.Context, checker HealthChecker, timeout time.Duration) HealthCheckResult {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("health check panicked: %v", r)
+			}
+		}()
+		done <- checker.CheckHealth(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("health check timed out after %s", timeout)
+	}
+
+	result := HealthCheckResult{
+		Status:     HealthStatusOK,
+		DurationMs: time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		result.Status = HealthStatusFailed
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// HealthzController is the liveness probe. It succeeds as long as the server is able
+// to process requests.
+var HealthzController Controller = Controller{
+	Name:      "HealthzController",
+	Metric:    "healthz",
+	Path:      "/healthz",
+	Methods:   []string{"GET"},
+	IsSecured: false,
+	ControllerFunc: func(ctx *Context) {
+		sendHealthResponse(ctx, HealthResponse{Status: HealthStatusOK})
+	},
+	Description: "Liveness probe",
+}
+
+// ReadyzController is the readiness probe. It returns 503 if any of the registered
+// health checks fails or the server is shutting down.
+var ReadyzController Controller = Controller{
+	Name:      "ReadyzController",
+	Metric:    "readyz",
+	Path:      "/readyz",
+	Methods:   []string{"GET"},
+	IsSecured: false,
+	ControllerFunc: func(ctx *Context) {
+		sendHealthResponse(ctx, ctx.Server.CheckReadiness(ctx.Request.Context()))
+	},
+	Description: "Readiness probe running all registered health checks",
+}
+
+func sendHealthResponse(ctx *Context, response HealthResponse) {
+	content, err := json.Marshal(response)
+	if err != nil {
+		ctx.SendJsonError(fmt.Errorf("error marshalling health response: %w", err))
+		return
+	}
+	code := http.StatusOK
+	if response.Status != HealthStatusOK {
+		code = http.StatusServiceUnavailable
+		ctx.LogWarnf("Health check failed: %s", content)
+	}
+	ctx.SendJSONResponse(code, content)
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ConfigHTTPClientTimeout limits the duration of calls made with Context.HTTPClient (default: no limit)
+const ConfigHTTPClientTimeout = "httpClientTimeout"
+
+// HTTPClient returns a client for calls to other services on behalf of the current request.
+// The client forwards the request id and the trace headers, logs every call with the
+// attributes of the request and records the latency in the outbound request metric.
+func (ctx *Context) HTTPClient() *http.Client {
+	return &http.Client{
+		Transport: &contextTransport{ctx: ctx, next: http.DefaultTransport},
+		Timeout:   ctx.Server.httpClientTimeout,
+	}
+}
+
+// contextTransport decorates outgoing requests with the request id and trace headers
+type contextTransport struct {
+	ctx  *Context
+	next http.RoundTripper
+}
+
+func (t *contextTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	ctx := t.ctx
+	parent := r.Context()
+	if !trace.SpanContextFromContext(parent).IsValid() {
+		parent = ctx.TraceContext()
+	}
+	spanCtx, span := ctx.Server.getTracer().Start(parent, r.Method+" "+r.URL.Host,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("url.full", r.URL.Redacted()),
+			attribute.String("server.address", r.URL.Host),
+		),
+	)
+	defer span.End()
+
+	// a RoundTripper must not modify the original request
+	out := r.Clone(spanCtx)
+	if out.Header.Get(HeaderRequestID) == "" {
+		out.Header.Set(HeaderRequestID, ctx.GetRequestID())
+	}
+	propagation.TraceContext{}.Inject(spanCtx, propagation.HeaderCarrier(out.Header))
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(out)
+	duration := time.Since(start)
+
+	attrs := []any{
+		slog.String("outbound_method", r.Method),
+		slog.String("outbound_url", r.URL.Redacted()),
+		slog.Duration("duration", duration),
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		ctx.Server.observeOutboundRequest(ctx, r, "error", duration)
+		ctx.log(slog.LevelWarn, "Outbound request failed", append(attrs, slog.String("error", err.Error()))...)
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	if resp.StatusCode >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, strconv.Itoa(resp.StatusCode))
+	}
+	ctx.Server.observeOutboundRequest(ctx, r, strconv.Itoa(resp.StatusCode), duration)
+	ctx.log(slog.LevelDebug, "Outbound request", append(attrs, slog.Int("status", resp.StatusCode))...)
+	return resp, nil
+}
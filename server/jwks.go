@@ -0,0 +1,432 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config properties of the JWKS handling
+const (
+	// ConfigJWKSURL overrides the JWKS URL of the issuer given by ConfigJWKSIssuer. By default
+	// it is discovered through <issuer>/.well-known/openid-configuration, falling back to
+	// <issuer>/.well-known/jwks.json. Use Server.SetJWKSProvider for further issuers.
+	ConfigJWKSURL = "jwks_url"
+	// ConfigJWKSIssuer is the issuer ConfigJWKSURL belongs to. Required if it is set.
+	ConfigJWKSIssuer = "jwks_issuer"
+	// ConfigJWKSRefreshInterval is the interval the keys are refreshed in the background (default 1h)
+	ConfigJWKSRefreshInterval = "jwks_refresh_interval"
+	// ConfigJWKSMinRefetchInterval limits how often tokens with an unknown kid trigger a refetch (default 30s)
+	ConfigJWKSMinRefetchInterval = "jwks_min_refetch_interval"
+	// ConfigJWKSHTTPTimeout limits the requests to the identity provider (default 10s)
+	ConfigJWKSHTTPTimeout = "jwks_http_timeout"
+)
+
+const (
+	defaultJWKSRefreshInterval    = time.Hour
+	defaultJWKSMinRefetchInterval = 30 * time.Second
+	defaultJWKSHTTPTimeout        = 10 * time.Second
+)
+
+// ErrUnknownKeyID is returned if a token was signed with a key that isn't part of the JWKS
+var ErrUnknownKeyID = errors.New("unknown key id")
+
+// errKeyAlgorithm is returned if the algorithm of a token doesn't match the key
+var errKeyAlgorithm = errors.New("key can't be used with algorithm")
+
+// SupportedJWTAlgorithms lists the signature algorithms accepted for tokens
+var SupportedJWTAlgorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// JWKSOptions customizes a JWKSProvider. Zero values are replaced by the defaults.
+type JWKSOptions struct {
+	URL                string // skips the discovery if set
+	RefreshInterval    time.Duration
+	MinRefetchInterval time.Duration
+	HTTPClient         *http.Client
+	Logger             *slog.Logger
+}
+
+// JWKSProvider fetches and caches the signing keys of an issuer. Once loaded, the keys
+// are refreshed in the background. Requests keep using the previous keys while a
+// refresh is in progress or if it fails. Tokens signed with an unknown key trigger
+// an immediate refetch, limited to one per MinRefetchInterval.
+type JWKSProvider struct {
+	issuer string
+	opts   JWKSOptions
+	mutex  sync.RWMutex
+	keys   map[string]jwk
+	// serializes the fetches, so a slow identity provider only blocks requests of this issuer
+	fetchMutex  sync.Mutex
+	lastAttempt time.Time
+	lastErr     error
+	refreshOnce sync.Once
+	stopOnce    sync.Once
+	stop        chan struct{}
+}
+
+// jwk is a parsed key of the JWKS
+type jwk struct {
+	key crypto.PublicKey
+	alg string // optional algorithm the key is restricted to
+}
+
+// Jwks used to marshal the key response from Auth0
+type Jwks struct {
+	Keys []JSONWebKeys `json:"keys"`
+}
+
+// JSONWebKeys used to marshal the key response from Auth0
+type JSONWebKeys struct {
+	Kty string   `json:"kty"`
+	Kid string   `json:"kid"`
+	Use string   `json:"use"`
+	Alg string   `json:"alg,omitempty"`
+	N   string   `json:"n,omitempty"`
+	E   string   `json:"e,omitempty"`
+	Crv string   `json:"crv,omitempty"`
+	X   string   `json:"x,omitempty"`
+	Y   string   `json:"y,omitempty"`
+	X5c []string `json:"x5c,omitempty"`
+}
+
+// NewJWKSProvider creates a provider for the given issuer. Keys are loaded on first use.
+func NewJWKSProvider(issuer string, opts JWKSOptions) *JWKSProvider {
+	if opts.RefreshInterval == 0 {
+		opts.RefreshInterval = defaultJWKSRefreshInterval
+	}
+	if opts.MinRefetchInterval == 0 {
+		opts.MinRefetchInterval = defaultJWKSMinRefetchInterval
+	}
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = &http.Client{Timeout: defaultJWKSHTTPTimeout}
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	return &JWKSProvider{
+		issuer: issuer,
+		opts:   opts,
+		stop:   make(chan struct{}),
+	}
+}
+
+// GetKey returns the key with the given id for verifying a signature with the given algorithm
+func (p *JWKSProvider) GetKey(ctx context.Context, kid string, alg string) (crypto.PublicKey, error) {
+	p.mutex.RLock()
+	key, found := p.keys[kid]
+	p.mutex.RUnlock()
+
+	if !found {
+		err := p.refetch(ctx)
+		if err != nil {
+			return nil, err
+		}
+		p.mutex.RLock()
+		key, found = p.keys[kid]
+		p.mutex.RUnlock()
+		if !found {
+			return nil, fmt.Errorf("%w: %s of issuer %s", ErrUnknownKeyID, kid, p.issuer)
+		}
+	}
+	err := checkKeyAlgorithm(key, alg)
+	if err != nil {
+		return nil, fmt.Errorf("%w: key %s: %w", errKeyAlgorithm, kid, err)
+	}
+	return key.key, nil
+}
+
+// Close stops the background refresh
+func (p *JWKSProvider) Close() {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+	})
+}
+
+// refetch loads the keys unless there was an attempt within MinRefetchInterval. This
+// way tokens with made up key ids can't be used to flood the identity provider.
+// The fetch isn't canceled with ctx, as its result is shared with all requests until
+// the next attempt. It's limited by the timeout of the HTTP client instead.
+func (p *JWKSProvider) refetch(ctx context.Context) error {
+	p.fetchMutex.Lock()
+	defer p.fetchMutex.Unlock()
+
+	if !p.lastAttempt.IsZero() && time.Since(p.lastAttempt) < p.opts.MinRefetchInterval {
+		// someone else fetched meanwhile or we refetched recently
+		return p.lastErr
+	}
+	p.lastAttempt = time.Now()
+	p.lastErr = p.fetch(context.WithoutCancel(ctx))
+	if p.lastErr != nil {
+		return p.lastErr
+	}
+	p.refreshOnce.Do(func() {
+		go p.refreshLoop()
+	})
+	return nil
+}
+
+func (p *JWKSProvider) refreshLoop() {
+	ticker := time.NewTicker(p.opts.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.fetchMutex.Lock()
+			err := p.fetch(context.Background())
+			p.fetchMutex.Unlock()
+			if err != nil {
+				p.opts.Logger.Warn("Refreshing JWKS failed. Keeping the previous keys", slog.String("issuer", p.issuer), slog.String("error", err.Error()))
+			}
+		}
+	}
+}
+
+// fetch loads the keys. Must be called holding fetchMutex.
+func (p *JWKSProvider) fetch(ctx context.Context) error {
+	url, err := p.getJWKSURL(ctx)
+	if err != nil {
+		return err
+	}
+	p.opts.Logger.Info("Loading JWKS", slog.String("issuer", p.issuer), slog.String("url", url))
+	jwks := Jwks{}
+	err = p.getJSON(ctx, url, &jwks)
+	if err != nil {
+		return fmt.Errorf("error fetching jwks of issuer %s: %w", p.issuer, err)
+	}
+
+	keys := make(map[string]jwk)
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := parseJWK(k)
+		if err != nil {
+			p.opts.Logger.Warn("Skipping invalid key of JWKS", slog.String("issuer", p.issuer), slog.String("kid", k.Kid), slog.String("error", err.Error()))
+			continue
+		}
+		keys[k.Kid] = key
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.keys = keys
+	return nil
+}
+
+// getJWKSURL returns the configured URL or discovers it through the OpenID configuration
+func (p *JWKSProvider) getJWKSURL(ctx context.Context) (string, error) {
+	if p.opts.URL != "" {
+		return p.opts.URL, nil
+	}
+	base := strings.TrimSuffix(p.issuer, "/")
+	discovery := struct {
+		JWKSURI string `json:"jwks_uri"`
+	}{}
+	err := p.getJSON(ctx, base+"/.well-known/openid-configuration", &discovery)
+	if err != nil || discovery.JWKSURI == "" {
+		return base + "/.well-known/jwks.json", nil
+	}
+	return discovery.JWKSURI, nil
+}
+
+func (p *JWKSProvider) getJSON(ctx context.Context, url string, target any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.opts.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error reading response of %s: %w", url, err)
+	}
+	err = json.Unmarshal(body, target)
+	if err != nil {
+		return fmt.Errorf("error unmarshaling response of %s: %w", url, err)
+	}
+	return nil
+}
+
+// parseJWK supports RSA keys given by modulus and exponent, EC keys and, as a
+// fallback, the first certificate of the x5c chain.
+func parseJWK(k JSONWebKeys) (jwk, error) {
+	key := jwk{alg: k.Alg}
+	switch {
+	case k.Kty == "RSA" && k.N != "" && k.E != "":
+		n, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(k.N, "="))
+		if err != nil {
+			return key, fmt.Errorf("invalid modulus: %w", err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(k.E, "="))
+		if err != nil {
+			return key, fmt.Errorf("invalid exponent: %w", err)
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 || exponent.Int64() < 3 {
+			return key, errors.New("invalid exponent")
+		}
+		key.key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}
+	case k.Kty == "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return key, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+		y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+		if err1 != nil || err2 != nil {
+			return key, errors.New("invalid coordinates")
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return key, errors.New("point is not on the curve")
+		}
+		key.key = pub
+	case len(k.X5c) > 0:
+		der, err := base64.StdEncoding.DecodeString(k.X5c[0])
+		if err != nil {
+			return key, fmt.Errorf("invalid certificate encoding: %w", err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return key, fmt.Errorf("invalid certificate: %w", err)
+		}
+		key.key = cert.PublicKey
+	default:
+		return key, fmt.Errorf("unsupported key type %s", k.Kty)
+	}
+	return key, nil
+}
+
+// checkKeyAlgorithm makes sure a key is only used with an algorithm matching its type
+func checkKeyAlgorithm(key jwk, alg string) error {
+	if key.alg != "" && key.alg != alg {
+		return fmt.Errorf("key is restricted to %s but token uses %s", key.alg, alg)
+	}
+	switch k := key.key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") && !strings.HasPrefix(alg, "PS") {
+			return fmt.Errorf("algorithm %s can't be used with an RSA key", alg)
+		}
+	case *ecdsa.PublicKey:
+		expected := map[string]string{"P-256": "ES256", "P-384": "ES384", "P-521": "ES512"}[k.Curve.Params().Name]
+		if alg != expected {
+			return fmt.Errorf("algorithm %s can't be used with an EC key on curve %s", alg, k.Curve.Params().Name)
+		}
+	default:
+		return fmt.Errorf("unsupported key type %T", key.key)
+	}
+	return nil
+}
+
+// jwksConfig are the JWKS config properties used to create the provider of an issuer
+type jwksConfig struct {
+	url     string
+	issuer  string // the issuer url applies to
+	refresh time.Duration
+	refetch time.Duration
+	timeout time.Duration
+}
+
+// loadJWKSConfig reads the JWKS config and makes sure the JWKS URL can't be applied to
+// the wrong issuer
+func loadJWKSConfig(config Config) (jwksConfig, error) {
+	refresh, err1 := config.GetDuration(ConfigJWKSRefreshInterval)
+	refetch, err2 := config.GetDuration(ConfigJWKSMinRefetchInterval)
+	timeout, err3 := config.GetDuration(ConfigJWKSHTTPTimeout)
+	if err := errors.Join(err1, err2, err3); err != nil {
+		return jwksConfig{}, fmt.Errorf("invalid jwks configuration: %w", err)
+	}
+	jc := jwksConfig{
+		url:     config.Get(ConfigJWKSURL),
+		issuer:  config.Get(ConfigJWKSIssuer),
+		refresh: refresh,
+		refetch: refetch,
+		timeout: timeout,
+	}
+	if jc.url != "" && jc.issuer == "" {
+		return jwksConfig{}, fmt.Errorf("%s requires %s to be set to the issuer of the keys", ConfigJWKSURL, ConfigJWKSIssuer)
+	}
+	return jc, nil
+}
+
+// getJWKSProvider returns the provider of the issuer, creating it from the config on first use
+func (s *Server) getJWKSProvider(issuer string) (*JWKSProvider, error) {
+	s.jwksMutex.Lock()
+	defer s.jwksMutex.Unlock()
+	if p, ok := s.jwksProviders[issuer]; ok {
+		return p, nil
+	}
+
+	jc := s.jwksConfig
+	if jc.timeout == 0 {
+		jc.timeout = defaultJWKSHTTPTimeout
+	}
+	url := ""
+	if jc.issuer == issuer {
+		url = jc.url
+	}
+	p := NewJWKSProvider(issuer, JWKSOptions{
+		URL:                url,
+		RefreshInterval:    jc.refresh,
+		MinRefetchInterval: jc.refetch,
+		HTTPClient:         &http.Client{Timeout: jc.timeout},
+		Logger:             s.Logger(),
+	})
+	s.setJWKSProvider(issuer, p)
+	return p, nil
+}
+
+// SetJWKSProvider overrides the provider used to validate tokens of the given issuer
+func (s *Server) SetJWKSProvider(issuer string, p *JWKSProvider) {
+	s.jwksMutex.Lock()
+	defer s.jwksMutex.Unlock()
+	s.setJWKSProvider(issuer, p)
+}
+
+func (s *Server) setJWKSProvider(issuer string, p *JWKSProvider) {
+	if s.jwksProviders == nil {
+		s.jwksProviders = make(map[string]*JWKSProvider)
+	}
+	if existing, ok := s.jwksProviders[issuer]; ok && existing != p {
+		existing.Close()
+	}
+	s.jwksProviders[issuer] = p
+}
+
+// closeJWKSProviders stops the background refresh of all providers
+func (s *Server) closeJWKSProviders() {
+	s.jwksMutex.Lock()
+	defer s.jwksMutex.Unlock()
+	for _, p := range s.jwksProviders {
+		p.Close()
+	}
+}
@@ -0,0 +1,272 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ConfigJWTClockSkew is the tolerance applied to the exp, nbf and iat claims (default 0)
+const ConfigJWTClockSkew = "jwt_clock_skew"
+
+// Errors returned by the JWT validation. Each of them results in a 401 response with a
+// specific message (see jwtErrorMessages). ErrUnknownKeyID is used for tokens signed with
+// a key missing in the JWKS.
+var (
+	ErrTokenMissing              = errors.New("token missing")
+	ErrTokenMalformed            = errors.New("token malformed")
+	ErrTokenUnsupportedAlgorithm = errors.New("unsupported signing algorithm")
+	ErrTokenInvalidIssuer        = errors.New("invalid issuer")
+	ErrTokenInvalidSignature     = errors.New("invalid signature")
+	ErrTokenExpired              = errors.New("token expired")
+	ErrTokenNotYetValid          = errors.New("token not yet valid")
+	ErrTokenInvalidAudience      = errors.New("invalid audience")
+	ErrTokenInvalidClaims        = errors.New("invalid claims")
+)
+
+var jwtErrorMessages = []struct {
+	err     error
+	message string
+}{
+	{ErrTokenMissing, "token_missing"},
+	{ErrTokenMalformed, "token_malformed"},
+	{ErrTokenUnsupportedAlgorithm, "unsupported_algorithm"},
+	{ErrTokenInvalidIssuer, "invalid_issuer"},
+	{ErrUnknownKeyID, "unknown_key_id"},
+	{ErrTokenInvalidSignature, "invalid_signature"},
+	{ErrTokenExpired, "token_expired"},
+	{ErrTokenNotYetValid, "token_not_yet_valid"},
+	{ErrTokenInvalidAudience, "invalid_audience"},
+	{ErrTokenInvalidClaims, "invalid_claims"},
+}
+
+// JWTClaims are the claims of a validated token
+type JWTClaims map[string]any
+
+// JWTOptions configures the validation of GetJwtAuthWithOptions
+type JWTOptions struct {
+	Issuers        []string                     // the iss claim must be one of them. The keys are taken from the JWKS of the issuer
+	Audiences      []string                     // if set, the aud claim must contain one of them
+	ClockSkew      time.Duration                // overrides ConfigJWTClockSkew if set
+	Validator      func(claims JWTClaims) error // optional, called with the claims of tokens passing all other checks
+	QueryParameter string                       // reads the token from this query parameter instead of the Authorization header
+}
+
+// GetJwtAuth validates bearer tokens of the given issuer. The signing keys are fetched
+// from the JWKS of the issuer (see ConfigJWKSURL for the configuration).
+func GetJwtAuth(issuer string, customValidator func(claims JWTClaims) error) AuthFunc {
+	return GetJwtAuthWithOptions(JWTOptions{
+		Issuers:   []string{issuer},
+		Validator: customValidator,
+	})
+}
+
+// GetJwtAuthFromQuery is like GetJwtAuth but reads the token from the given query parameter
+func GetJwtAuthFromQuery(issuer string, customValidator func(claims JWTClaims) error, parameterName string) AuthFunc {
+	return GetJwtAuthWithOptions(JWTOptions{
+		Issuers:        []string{issuer},
+		Validator:      customValidator,
+		QueryParameter: parameterName,
+	})
+}
+
+// GetJwtAuthWithOptions validates tokens signed with RS*, PS* or ES* keys of the JWKS of
+// one of the configured issuers. exp, nbf and iat are checked with the configured clock skew.
+// Failures are returned as JSONErrorResponse with code 401 and a message naming the reason,
+// e.g. token_expired or invalid_signature.
+func GetJwtAuthWithOptions(opts JWTOptions) AuthFunc {
+	return func(ctx *Context) error {
+		claims, err := ctx.Server.validateJWT(ctx.Request.Context(), extractJWT(ctx.Request, opts.QueryParameter), opts)
+		if err != nil {
+			return newJWTErrorResponse(err)
+		}
+		ctx.SetPrincipal(ctx.Server.principalFromClaims(claims))
+		return nil
+	}
+}
+
+// extractJWT reads the token from the query parameter or the bearer Authorization header
+func extractJWT(r *http.Request, queryParameter string) string {
+	if queryParameter != "" {
+		return r.URL.Query().Get(queryParameter)
+	}
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+func newJWTErrorResponse(err error) JSONErrorResponse {
+	message := "unauthorized"
+	for _, m := range jwtErrorMessages {
+		if errors.Is(err, m.err) {
+			message = m.message
+			break
+		}
+	}
+	return JSONErrorResponse{
+		Code:       http.StatusUnauthorized,
+		Message:    message,
+		LogMessage: fmt.Sprintf("jwt validation failed: %s", err.Error()),
+	}
+}
+
+// validateJWT checks the token and returns its claims. The issuer is checked first as it
+// determines the JWKS, all other claims only after the signature was verified.
+func (s *Server) validateJWT(ctx context.Context, token string, opts JWTOptions) (JWTClaims, error) {
+	if token == "" {
+		return nil, ErrTokenMissing
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: expected 3 parts but got %d", ErrTokenMalformed, len(parts))
+	}
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	err := decodeJWTPart(parts[0], &header)
+	if err != nil {
+		return nil, fmt.Errorf("%w: header: %w", ErrTokenMalformed, err)
+	}
+	claims := JWTClaims{}
+	err = decodeJWTPart(parts[1], &claims)
+	if err != nil {
+		return nil, fmt.Errorf("%w: claims: %w", ErrTokenMalformed, err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature: %w", ErrTokenMalformed, err)
+	}
+
+	if !slices.Contains(SupportedJWTAlgorithms, header.Alg) {
+		return nil, fmt.Errorf("%w: %s", ErrTokenUnsupportedAlgorithm, header.Alg)
+	}
+	issuer, _ := claims["iss"].(string)
+	if !slices.Contains(opts.Issuers, issuer) {
+		return nil, fmt.Errorf("%w: %s", ErrTokenInvalidIssuer, issuer)
+	}
+	provider, err := s.getJWKSProvider(issuer)
+	if err != nil {
+		return nil, err
+	}
+	key, err := provider.GetKey(ctx, header.Kid, header.Alg)
+	if err != nil {
+		if errors.Is(err, errKeyAlgorithm) {
+			return nil, fmt.Errorf("%w: %w", ErrTokenInvalidSignature, err)
+		}
+		return nil, fmt.Errorf("unable to get signing key from JWKS: %w", err)
+	}
+	err = verifyJWTSignature(header.Alg, key, parts[0]+"."+parts[1], signature)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.validateJWTClaims(claims, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Validator != nil {
+		err = opts.Validator(claims)
+		if err != nil {
+			return nil, fmt.Errorf("%w: custom claims validator returned error: %w", ErrTokenInvalidClaims, err)
+		}
+	}
+	return claims, nil
+}
+
+// validateJWTClaims checks the time based claims and the audience
+func (s *Server) validateJWTClaims(claims JWTClaims, opts JWTOptions) error {
+	skew := opts.ClockSkew
+	if skew == 0 {
+		skew = s.jwtClockSkew
+	}
+	now := time.Now()
+	for _, name := range []string{"exp", "nbf", "iat"} {
+		value, present := claims[name]
+		if !present {
+			continue
+		}
+		seconds, ok := value.(float64)
+		if !ok {
+			return fmt.Errorf("%w: %s claim is not a number", ErrTokenMalformed, name)
+		}
+		t := time.Unix(int64(seconds), 0)
+		switch {
+		case name == "exp" && !now.Before(t.Add(skew)):
+			return fmt.Errorf("%w: expired at %s", ErrTokenExpired, t.Format(time.RFC3339))
+		case name == "nbf" && now.Add(skew).Before(t):
+			return fmt.Errorf("%w: not valid before %s", ErrTokenNotYetValid, t.Format(time.RFC3339))
+		case name == "iat" && now.Add(skew).Before(t):
+			return fmt.Errorf("%w: issued in the future at %s", ErrTokenNotYetValid, t.Format(time.RFC3339))
+		}
+	}
+
+	if len(opts.Audiences) > 0 && !slices.ContainsFunc(claimAsStrings(claims["aud"]), func(aud string) bool {
+		return slices.Contains(opts.Audiences, aud)
+	}) {
+		return fmt.Errorf("%w: %v", ErrTokenInvalidAudience, claims["aud"])
+	}
+	return nil
+}
+
+func decodeJWTPart(part string, target any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, target)
+}
+
+// verifyJWTSignature checks the signature of the signing input (header.claims) with the key
+func verifyJWTSignature(alg string, key crypto.PublicKey, signingInput string, signature []byte) error {
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("%w: %s", ErrTokenUnsupportedAlgorithm, alg)
+	}
+	h := hash.New()
+	h.Write([]byte(signingInput))
+	digest := h.Sum(nil)
+
+	var valid bool
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(alg, "PS") {
+			valid = rsa.VerifyPSS(k, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto}) == nil
+		} else {
+			valid = rsa.VerifyPKCS1v15(k, hash, digest, signature) == nil
+		}
+	case *ecdsa.PublicKey:
+		// JWS uses the fixed size concatenation of r and s instead of ASN.1
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(signature) == 2*size {
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			valid = ecdsa.Verify(k, digest, r, s)
+		}
+	default:
+		return fmt.Errorf("%w: unsupported key type %T", ErrTokenInvalidSignature, key)
+	}
+	if !valid {
+		return ErrTokenInvalidSignature
+	}
+	return nil
+}
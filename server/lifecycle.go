@@ -0,0 +1,211 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultShutdownTimeout = 30 * time.Second
+)
+
+// StartHook can be implemented by the Repository, services and ControllerProviders
+// that need to run code before the server accepts requests. Hooks are called in
+// the following order: the repository, the services in registration order and
+// finally the ControllerProviders in the order they were passed to CreateServer.
+type StartHook interface {
+	OnStart(ctx context.Context) error
+}
+
+// StopHook is the counterpart of StartHook. Stop hooks are called in reverse start
+// order once all in-flight requests have been drained. This way the repository is
+// always closed last.
+type StopHook interface {
+	OnStop(ctx context.Context) error
+}
+
+// Run listens on the configured port and blocks until the given context is cancelled
+// or the process receives SIGINT or SIGTERM. The server is then shut down gracefully
+// within the configured shutdownTimeout (default 30s).
+func (s *Server) Run(ctx context.Context) error {
+	port := s.config.Get(ConfigPort)
+	l, err := net.Listen("tcp", fmt.Sprintf(":%s", port))
+	if err != nil {
+		return fmt.Errorf("error listening on port %s: %w", port, err)
+	}
+	return s.Serve(ctx, l)
+}
+
+// Serve is like Run but accepts connections on the provided listener. Tests can use
+// it to run a server on an ephemeral port: net.Listen("tcp", "127.0.0.1:0").
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	httpSrv, err := s.createHTTPServer()
+	if err != nil {
+		l.Close()
+		return err
+	}
+
+	s.lifecycleMutex.Lock()
+	if s.httpSrv != nil {
+		s.lifecycleMutex.Unlock()
+		l.Close()
+		return errors.New("server is already running")
+	}
+	s.httpSrv = httpSrv
+	s.stopped = make(chan struct{})
+	s.lifecycleMutex.Unlock()
+
+	err = s.ValidateServices()
+	if err == nil {
+		err = s.runStartHooks(ctx)
+	}
+	if err != nil {
+		l.Close()
+		s.lifecycleMutex.Lock()
+		s.httpSrv = nil
+		s.lifecycleMutex.Unlock()
+		return err
+	}
+
+	s.Logger().Info("Starting listening", slog.String("address", l.Addr().String()))
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- httpSrv.Serve(l)
+	}()
+
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			sctx, cancel := context.WithTimeout(context.Background(), s.getShutdownTimeout())
+			defer cancel()
+			return errors.Join(fmt.Errorf("server stopped unexpectedly: %w", err), s.Shutdown(sctx))
+		}
+		// Shutdown was triggered from outside. Wait until it completed.
+		<-s.stopped
+		return s.shutdownErr
+	case <-ctx.Done():
+		s.Logger().Info("Received shutdown signal")
+		sctx, cancel := context.WithTimeout(context.Background(), s.getShutdownTimeout())
+		defer cancel()
+		return s.Shutdown(sctx)
+	}
+}
+
+// Shutdown stops accepting new connections, waits for all in-flight requests and
+// WebSocket handlers to finish and then calls the stop hooks. If the context expires before all requests
+// are drained, the remaining connections are closed forcefully.
+// It's safe to call Shutdown multiple times and on a server that never started.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.lifecycleMutex.Lock()
+	httpSrv, stopped := s.httpSrv, s.stopped
+	s.lifecycleMutex.Unlock()
+	if httpSrv == nil {
+		return nil
+	}
+
+	s.shutdownOnce.Do(func() {
+		defer close(stopped)
+		s.shuttingDown.Store(true)
+		s.Logger().Info("Shutting down: draining in-flight requests")
+		errs := []error{}
+		err := httpSrv.Shutdown(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error draining in-flight requests: %w", err))
+			httpSrv.Close()
+		} else {
+			// all upgrades are registered once the requests are drained
+			errs = append(errs, s.waitForWebSockets(ctx))
+		}
+		targets := s.getLifecycleTargets(true)
+		errs = append(errs, s.runStopHooks(ctx, targets))
+		errs = append(errs, s.shutdownTracerProvider(ctx))
+		s.closeJWKSProviders()
+		s.shutdownErr = errors.Join(errs...)
+		s.Logger().Info("Shutdown completed")
+	})
+	<-stopped
+	return s.shutdownErr
+}
+
+func (s *Server) createHTTPServer() (*http.Server, error) {
+	rt, err1 := s.config.GetDuration(ConfigReadTimeout)
+	wt, err2 := s.config.GetDuration(ConfigWriteTimeout)
+	if err1 != nil || err2 != nil {
+		return nil, fmt.Errorf("invalid timeout configuration: %w", errors.Join(err1, err2))
+	}
+	httpSrv := &http.Server{
+		ReadTimeout:  rt,
+		WriteTimeout: wt,
+		Handler:      s.requestHandler,
+	}
+	httpSrv.RegisterOnShutdown(s.stopStreams)
+	return httpSrv, nil
+}
+
+func (s *Server) getShutdownTimeout() time.Duration {
+	timeout, err := s.config.GetDuration(ConfigShutdownTimeout)
+	if err != nil {
+		s.Logger().Error("Invalid shutdown timeout. Using default", slog.String("error", err.Error()), slog.Duration("default", defaultShutdownTimeout))
+		return defaultShutdownTimeout
+	}
+	if timeout == 0 {
+		return defaultShutdownTimeout
+	}
+	return timeout
+}
+
+// getLifecycleTargets returns everything that may implement StartHook or StopHook
+// in start order. Lazily constructed services are only included if includeLazy is set.
+func (s *Server) getLifecycleTargets(includeLazy bool) []any {
+	targets := []any{}
+	if s.repository != nil {
+		targets = append(targets, s.repository)
+	}
+	targets = append(targets, s.getServiceRegistry().getServices(includeLazy)...)
+	for _, ctrProv := range s.controllerProviders {
+		targets = append(targets, ctrProv)
+	}
+	return targets
+}
+
+func (s *Server) runStartHooks(ctx context.Context) error {
+	targets := s.getLifecycleTargets(false)
+	for i, target := range targets {
+		hook, ok := target.(StartHook)
+		if !ok {
+			continue
+		}
+		err := hook.OnStart(ctx)
+		if err != nil {
+			err = fmt.Errorf("start hook of %T failed: %w", target, err)
+			// release whatever has been started already
+			return errors.Join(err, s.runStopHooks(ctx, targets[:i]))
+		}
+	}
+	return nil
+}
+
+func (s *Server) runStopHooks(ctx context.Context, targets []any) error {
+	errs := []error{}
+	for i := len(targets) - 1; i >= 0; i-- {
+		hook, ok := targets[i].(StopHook)
+		if !ok {
+			continue
+		}
+		err := hook.OnStop(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("stop hook of %T failed: %w", targets[i], err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,321 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Supported values of the log_format config property
+const (
+	LogFormatJSON = "json"
+	LogFormatText = "text"
+)
+
+// LevelTrace is more verbose than slog.LevelDebug
+const LevelTrace = slog.Level(-8)
+
+var logLevelNames = map[string]slog.Level{
+	LogLevelTrace: LevelTrace,
+	LogLevelDebug: slog.LevelDebug,
+	LogLevelInfo:  slog.LevelInfo,
+	LogLevelWarn:  slog.LevelWarn,
+	LogLevelError: slog.LevelError,
+}
+
+// ParseLogLevel converts one of trace, debug, info, warn or error into a slog.Level
+func ParseLogLevel(level string) (slog.Level, error) {
+	l, ok := logLevelNames[strings.ToLower(level)]
+	if !ok {
+		return slog.LevelInfo, fmt.Errorf("invalid log level %s. Expecting one of %s, %s, %s, %s or %s", level, LogLevelTrace, LogLevelDebug, LogLevelInfo, LogLevelWarn, LogLevelError)
+	}
+	return l, nil
+}
+
+// LogLevelName is the inverse of ParseLogLevel
+func LogLevelName(level slog.Level) string {
+	for name, l := range logLevelNames {
+		if l == level {
+			return name
+		}
+	}
+	return strings.ToLower(level.String())
+}
+
+// logLevels holds the default log level and the per controller overrides.
+// It can be changed at runtime.
+type logLevels struct {
+	mutex       sync.RWMutex
+	level       slog.Level
+	controllers map[string]slog.Level
+}
+
+func (l *logLevels) get(controller string) slog.Level {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	level, ok := l.controllers[controller]
+	if !ok {
+		return l.level
+	}
+	return level
+}
+
+// levelFilterHandler decides based on the log levels of the server whether a
+// message is passed on to the actual handler.
+type levelFilterHandler struct {
+	next       slog.Handler
+	levels     *logLevels
+	controller string
+}
+
+func (h *levelFilterHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.levels.get(h.controller) && h.next.Enabled(ctx, level)
+}
+
+func (h *levelFilterHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.next.Handle(ctx, r)
+}
+
+func (h *levelFilterHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelFilterHandler{next: h.next.WithAttrs(attrs), levels: h.levels, controller: h.controller}
+}
+
+func (h *levelFilterHandler) WithGroup(name string) slog.Handler {
+	return &levelFilterHandler{next: h.next.WithGroup(name), levels: h.levels, controller: h.controller}
+}
+
+// newLogHandler creates one of the built-in handlers writing to w. The filtering
+// by level happens in levelFilterHandler, so the handler lets everything pass.
+func newLogHandler(format string, w io.Writer) slog.Handler {
+	opts := &slog.HandlerOptions{
+		Level: LevelTrace,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.LevelKey && len(groups) == 0 {
+				if level, ok := a.Value.Any().(slog.Level); ok && level == LevelTrace {
+					a.Value = slog.StringValue("TRACE")
+				}
+			}
+			return a
+		},
+	}
+	if strings.ToLower(format) == LogFormatText {
+		return slog.NewTextHandler(w, opts)
+	}
+	return slog.NewJSONHandler(w, opts)
+}
+
+// SetLogHandler replaces the handler all server and context log messages are passed to.
+// This allows to plug in any slog compatible backend. Messages below the configured
+// log levels never reach the handler. Must be called before the server is started.
+func (s *Server) SetLogHandler(handler slog.Handler) {
+	s.logHandler = handler
+	s.logger = s.newLogger("")
+}
+
+// Logger returns the server's logger. Within a request, use Context.Logger instead
+// as it carries the request attributes.
+func (s *Server) Logger() *slog.Logger {
+	if s.logger == nil {
+		s.SetLogHandler(newLogHandler(LogFormatJSON, os.Stderr))
+	}
+	return s.logger
+}
+
+// newLogger creates a logger honoring the log level of the given controller
+func (s *Server) newLogger(controller string) *slog.Logger {
+	if s.logHandler == nil {
+		s.logHandler = newLogHandler(LogFormatJSON, os.Stderr)
+	}
+	return slog.New(&levelFilterHandler{
+		next:       s.logHandler,
+		levels:     s.getLogLevels(),
+		controller: controller,
+	})
+}
+
+func (s *Server) getLogLevels() *logLevels {
+	if s.logLevels == nil {
+		s.logLevels = &logLevels{
+			level:       slog.LevelInfo,
+			controllers: make(map[string]slog.Level),
+		}
+	}
+	return s.logLevels
+}
+
+// SetLogLevel changes the default log level. Can be called at runtime.
+func (s *Server) SetLogLevel(level string) error {
+	l, err := ParseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	levels := s.getLogLevels()
+	levels.mutex.Lock()
+	defer levels.mutex.Unlock()
+	levels.level = l
+	return nil
+}
+
+// GetLogLevel returns the default log level
+func (s *Server) GetLogLevel() string {
+	levels := s.getLogLevels()
+	levels.mutex.RLock()
+	defer levels.mutex.RUnlock()
+	return LogLevelName(levels.level)
+}
+
+// ErrUnknownController is returned when changing the log level of a controller that isn't registered
+var ErrUnknownController = errors.New("unknown controller")
+
+// SetControllerLogLevel overrides the default log level for the given controller.
+// An empty level removes the override. Can be called at runtime. Returns ErrUnknownController
+// if no controller with that name is registered.
+func (s *Server) SetControllerLogLevel(controller string, level string) error {
+	if !slices.ContainsFunc(s.controllers, func(c Controller) bool { return c.Name == controller }) {
+		return fmt.Errorf("%w: %s", ErrUnknownController, controller)
+	}
+	levels := s.getLogLevels()
+	if level == "" {
+		levels.mutex.Lock()
+		defer levels.mutex.Unlock()
+		delete(levels.controllers, controller)
+		return nil
+	}
+	l, err := ParseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	levels.mutex.Lock()
+	defer levels.mutex.Unlock()
+	levels.controllers[controller] = l
+	return nil
+}
+
+// GetControllerLogLevels returns all per controller overrides
+func (s *Server) GetControllerLogLevels() map[string]string {
+	levels := s.getLogLevels()
+	levels.mutex.RLock()
+	defer levels.mutex.RUnlock()
+	overrides := make(map[string]string)
+	for ctr, l := range levels.controllers {
+		overrides[ctr] = LogLevelName(l)
+	}
+	return overrides
+}
+
+// loadLogLevel reads the default level from the config
+func (s *Server) loadLogLevel(config Config) error {
+	ll := config.Get(ConfigLogLevel)
+	if ll == "" {
+		return nil
+	}
+	return s.SetLogLevel(ll)
+}
+
+// loadControllerLogLevels reads the per controller overrides from the config once the
+// controllers are registered. Overrides are expected in the format: ControllerA:debug,ControllerB:warn
+func (s *Server) loadControllerLogLevels(config Config) error {
+	overrides := config.Get(ConfigControllerLogLevels)
+	if overrides == "" {
+		return nil
+	}
+	for _, override := range strings.Split(overrides, ",") {
+		ctr, level, ok := strings.Cut(strings.TrimSpace(override), ":")
+		if !ok {
+			return fmt.Errorf("invalid controller log level %s. Expecting <controller>:<level>", override)
+		}
+		err := s.SetControllerLogLevel(strings.TrimSpace(ctr), strings.TrimSpace(level))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LogLevelsResponse is returned by the log level admin controller
+type LogLevelsResponse struct {
+	Level       string            `json:"level"`
+	Controllers map[string]string `json:"controllers"`
+}
+
+// LogLevelRequest changes the default level or, if Controller is set, the level of
+// that controller. An empty level for a controller removes the override.
+type LogLevelRequest struct {
+	Controller string `json:"controller"`
+	Level      string `json:"level"`
+}
+
+// EnableLogLevelAdmin registers a controller on /admin/loglevel that shows the
+// current log levels (GET) and allows to change them at runtime (PUT).
+// The endpoint is always secured with the given auth function.
+func (s *Server) EnableLogLevelAdmin(authFunc AuthFunc) {
+	if authFunc == nil {
+		panic("the log level admin endpoint requires an auth function")
+	}
+	s.registerController(s.router, Controller{
+		Name:           "LogLevelAdminController",
+		Metric:         "loglevel_admin",
+		Path:           "/admin/loglevel",
+		Methods:        []string{http.MethodGet, http.MethodPut},
+		IsSecured:      true,
+		AuthFunc:       authFunc,
+		ControllerFunc: logLevelAdmin,
+		Description:    "Shows and changes the log levels at runtime",
+	})
+}
+
+func logLevelAdmin(ctx *Context) {
+	if ctx.Request.Method == http.MethodPut {
+		body, err := ctx.GetRequestBody()
+		if err != nil {
+			ctx.SendJsonError(err)
+			return
+		}
+		req := LogLevelRequest{}
+		err = json.Unmarshal(body, &req)
+		if err != nil {
+			ctx.SendJsonError(JSONErrorResponse{
+				Code:       http.StatusBadRequest,
+				Message:    "invalid_request_body",
+				LogMessage: fmt.Sprintf("error unmarshalling log level request: %s", err),
+			})
+			return
+		}
+		if req.Controller != "" {
+			err = ctx.Server.SetControllerLogLevel(req.Controller, req.Level)
+		} else {
+			err = ctx.Server.SetLogLevel(req.Level)
+		}
+		if err != nil {
+			message := "invalid_log_level"
+			if errors.Is(err, ErrUnknownController) {
+				message = "unknown_controller"
+			}
+			ctx.SendJsonError(JSONErrorResponse{
+				Code:       http.StatusBadRequest,
+				Message:    message,
+				LogMessage: err.Error(),
+			})
+			return
+		}
+		ctx.LogInfof("Changed log level of '%s' to '%s'", req.Controller, req.Level)
+	}
+
+	content, err := json.Marshal(LogLevelsResponse{
+		Level:       ctx.Server.GetLogLevel(),
+		Controllers: ctx.Server.GetControllerLogLevels(),
+	})
+	if err != nil {
+		ctx.SendJsonError(fmt.Errorf("error marshalling log levels: %w", err))
+		return
+	}
+	ctx.SendJSONResponse(http.StatusOK, content)
+}
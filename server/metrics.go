@@ -0,0 +1,250 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Reasons reported by the auth failure counter
+const (
+	AuthFailureUnauthenticated = "unauthenticated"
+	AuthFailureForbidden       = "forbidden"
+)
+
+// serverMetrics holds all prometheus collectors of a server. Every server has its own
+// registry, so multiple servers can live in the same process.
+type serverMetrics struct {
+	registry        *prometheus.Registry
+	requestDuration *prometheus.HistogramVec
+	inFlight        prometheus.Gauge
+	requestSize     *prometheus.HistogramVec
+	responseSize    *prometheus.HistogramVec
+	authFailures    *prometheus.CounterVec
+	panics          *prometheus.CounterVec
+	outbound        *prometheus.HistogramVec
+	rateLimited     *prometheus.CounterVec
+	streamDuration  *prometheus.HistogramVec
+	wsMessages      *prometheus.CounterVec
+}
+
+func newServerMetrics(statusInfo *StatusInformation) *serverMetrics {
+	sizeBuckets := prometheus.ExponentialBuckets(64, 4, 10)
+	durationBuckets := []float64{1, 10, 50, 100, 200, 400, 800, 1500, 3000, 10000, 30000, 60000}
+	m := &serverMetrics{
+		registry: prometheus.NewRegistry(),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "ssf_server_controller_requestcount",
+			Help:    "Duration of controller invokations in ms",
+			Buckets: durationBuckets,
+		}, []string{"controller", "route", "method", "code", "tenant"}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "ssf_server_requests_in_flight",
+			Help: "Number of requests currently being processed by controllers",
+		}),
+		requestSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "ssf_server_request_size_bytes",
+			Help:    "Size of the request bodies as announced by the Content-Length header",
+			Buckets: sizeBuckets,
+		}, []string{"controller"}),
+		responseSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "ssf_server_response_size_bytes",
+			Help:    "Size of the response bodies",
+			Buckets: sizeBuckets,
+		}, []string{"controller"}),
+		authFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ssf_server_auth_failures_total",
+			Help: "Counts the number of failed authentications and authorizations",
+		}, []string{"controller", "reason"}),
+		panics: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ssf_server_controller_panics_total",
+			Help: "Counts the number of panics recovered per controller",
+		}, []string{"controller"}),
+		outbound: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "ssf_server_outbound_request_duration_ms",
+			Help:    "Duration of outgoing HTTP calls made with Context.HTTPClient in ms",
+			Buckets: durationBuckets,
+		}, []string{"controller", "host", "method", "code"}),
+		rateLimited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ssf_server_rate_limited_total",
+			Help: "Counts the number of requests rejected by the rate limit of the controller",
+		}, []string{"controller"}),
+		streamDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "ssf_server_stream_duration_seconds",
+			Help:    "Duration of server-sent event streams and WebSocket connections in seconds",
+			Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+		}, []string{"controller", "type"}),
+		wsMessages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ssf_server_websocket_messages_total",
+			Help: "Counts the WebSocket messages sent and received",
+		}, []string{"controller", "direction"}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requestDuration,
+		m.inFlight,
+		m.requestSize,
+		m.responseSize,
+		m.authFailures,
+		m.rateLimited,
+		m.streamDuration,
+		m.wsMessages,
+		m.panics,
+		m.outbound,
+		newStatusCollector(statusInfo),
+	)
+	return m
+}
+
+// MetricsRegistry gives access to the prometheus registry of the server, so applications
+// can register their own collectors. Returns nil if prometheus is not enabled.
+func (s *Server) MetricsRegistry() *prometheus.Registry {
+	if s.metrics == nil {
+		return nil
+	}
+	return s.metrics.registry
+}
+
+func (s *Server) getMetricsHandler() http.Handler {
+	return promhttp.HandlerFor(s.metrics.registry, promhttp.HandlerOpts{})
+}
+
+func (s *Server) observeRequest(ctx *Context, duration time.Duration, written int64) {
+	if s.metrics == nil {
+		return
+	}
+	name := ctx.Controller.Name
+	code := ctx.ResponseCode
+	if code == 0 {
+		code = http.StatusOK
+	}
+	s.metrics.requestDuration.With(prometheus.Labels{
+		"controller": name,
+		"route":      ctx.Route,
+		"method":     ctx.Request.Method,
+		"code":       strconv.Itoa(code),
+		"tenant":     ctx.tenantLabel(),
+	}).Observe(float64(duration) / float64(time.Millisecond))
+	if ctx.Request.ContentLength >= 0 {
+		s.metrics.requestSize.With(prometheus.Labels{"controller": name}).Observe(float64(ctx.Request.ContentLength))
+	}
+	s.metrics.responseSize.With(prometheus.Labels{"controller": name}).Observe(float64(written))
+}
+
+func (s *Server) countAuthFailure(ctx *Context, reason string) {
+	if s.metrics == nil {
+		return
+	}
+	s.metrics.authFailures.With(prometheus.Labels{"controller": ctx.Controller.Name, "reason": reason}).Inc()
+}
+
+func (s *Server) countRateLimited(ctx *Context) {
+	ctx.StatusInformation.IncrementMetric(MetricRateLimited)
+	if s.metrics == nil {
+		return
+	}
+	s.metrics.rateLimited.With(prometheus.Labels{"controller": ctx.Controller.Name}).Inc()
+}
+
+func (s *Server) observeStream(ctx *Context, streamType string, duration time.Duration) {
+	if s.metrics == nil {
+		return
+	}
+	s.metrics.streamDuration.With(prometheus.Labels{"controller": ctx.Controller.Name, "type": streamType}).Observe(duration.Seconds())
+}
+
+func (s *Server) countWebSocketMessage(ctx *Context, direction string) {
+	if s.metrics == nil {
+		return
+	}
+	s.metrics.wsMessages.With(prometheus.Labels{"controller": ctx.Controller.Name, "direction": direction}).Inc()
+}
+
+func (s *Server) observeOutboundRequest(ctx *Context, r *http.Request, code string, duration time.Duration) {
+	if s.metrics == nil {
+		return
+	}
+	s.metrics.outbound.With(prometheus.Labels{
+		"controller": ctx.Controller.Name,
+		"host":       r.URL.Host,
+		"method":     r.Method,
+		"code":       code,
+	}).Observe(float64(duration) / float64(time.Millisecond))
+}
+
+// statusCollector exports all metrics of the StatusInformation as gauges
+type statusCollector struct {
+	statusInfo *StatusInformation
+	desc       *prometheus.Desc
+}
+
+func newStatusCollector(statusInfo *StatusInformation) *statusCollector {
+	return &statusCollector{
+		statusInfo: statusInfo,
+		desc: prometheus.NewDesc(
+			"ssf_server_status_metric",
+			"Current value of the metrics shown on the status page",
+			[]string{"metric"}, nil,
+		),
+	}
+}
+
+func (c *statusCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *statusCollector) Collect(ch chan<- prometheus.Metric) {
+	for metric, value := range c.statusInfo.snapshot() {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(value), metric)
+	}
+}
+
+// responseWriter keeps track of the status code and the number of bytes written
+type responseWriter struct {
+	http.ResponseWriter
+	code    int
+	written int64
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+// Unwrap allows http.ResponseController to access the original writer
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *responseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer doesn't support hijacking")
+	}
+	return h.Hijack()
+}
@@ -0,0 +1,33 @@
+package server
+
+// Middleware wraps the execution of a controller. A middleware has to call next to
+// continue the chain. By not calling next it short-circuits the request and is then
+// responsible for sending a response, e.g. with ctx.SendJsonError. Once next returns,
+// ctx.ResponseCode holds the code sent by the controller.
+type Middleware func(ctx *Context, next func(ctx *Context))
+
+// Use adds global middlewares which are executed for every controller in the given
+// order and before the controller specific ones. Must be called before the server is
+// started.
+func (s *Server) Use(middlewares ...Middleware) {
+	s.middlewares = append(s.middlewares, middlewares...)
+}
+
+// getMiddlewares returns the global middlewares followed by those of the controller
+func (s *Server) getMiddlewares(c *Controller) []Middleware {
+	middlewares := make([]Middleware, 0, len(s.middlewares)+len(c.Middlewares))
+	middlewares = append(middlewares, s.middlewares...)
+	middlewares = append(middlewares, c.Middlewares...)
+	return middlewares
+}
+
+// runMiddlewares executes the chain of middlewares and calls final at its end
+func runMiddlewares(ctx *Context, middlewares []Middleware, final func(ctx *Context)) {
+	if len(middlewares) == 0 {
+		final(ctx)
+		return
+	}
+	middlewares[0](ctx, func(ctx *Context) {
+		runMiddlewares(ctx, middlewares[1:], final)
+	})
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Config properties naming the JWT claims scopes and roles are read from. By default
+// scopes are read from scope or scp and roles from roles.
+const (
+	ConfigJWTScopesClaim = "jwt_scopes_claim"
+	ConfigJWTRolesClaim  = "jwt_roles_claim"
+)
+
+const (
+	defaultRolesClaim = "roles"
+)
+
+// Authentication methods reported by Principal.AuthMethod
+const (
+	AuthMethodJWT    = "jwt"
+	AuthMethodAPIKey = "api_key"
+	AuthMethodBasic  = "basic"
+	AuthMethodHMAC   = "hmac"
+)
+
+// Principal is the authenticated caller of a request. It is set by the AuthFunc
+// of secured controllers and available through Context.Principal.
+type Principal struct {
+	Subject    string
+	Issuer     string
+	Audiences  []string
+	Scopes     []string
+	Roles      []string
+	Claims     map[string]any // raw claims of the token. Empty for other auth methods
+	AuthMethod string
+}
+
+// HasScope returns true if the principal was granted the given scope
+func (p *Principal) HasScope(scope string) bool {
+	return p != nil && slices.Contains(p.Scopes, scope)
+}
+
+// HasRole returns true if the principal has the given role
+func (p *Principal) HasRole(role string) bool {
+	return p != nil && slices.Contains(p.Roles, role)
+}
+
+// Principal returns the authenticated caller or nil if the request wasn't authenticated
+func (ctx *Context) Principal() *Principal {
+	return ctx.principal
+}
+
+// SetPrincipal is called by AuthFuncs after successful authentication. The subject is
+// added to all subsequent log messages of the request.
+func (ctx *Context) SetPrincipal(p *Principal) {
+	ctx.principal = p
+	if p != nil {
+		ctx.AddLogAttrs("subject", p.Subject)
+	}
+}
+
+// principalFromClaims maps the registered claims of a token to a Principal. Scopes and
+// roles are read from the configured claims (see ConfigJWTScopesClaim and ConfigJWTRolesClaim).
+// Without configuration, scopes are read from the space separated scope claim or from the
+// scp claim (string or list) and roles from the roles claim.
+func (s *Server) principalFromClaims(claims map[string]any) *Principal {
+	p := &Principal{
+		AuthMethod: AuthMethodJWT,
+		Claims:     claims,
+	}
+	p.Subject, _ = claims["sub"].(string)
+	p.Issuer, _ = claims["iss"].(string)
+	p.Audiences = claimAsStrings(claims["aud"])
+
+	if scopesClaim := s.jwtScopesClaim; scopesClaim != "" {
+		p.Scopes = claimAsStrings(claims[scopesClaim])
+	} else if scope, ok := claims["scope"]; ok {
+		p.Scopes = claimAsStrings(scope)
+	} else {
+		p.Scopes = claimAsStrings(claims["scp"])
+	}
+
+	rolesClaim := s.jwtRolesClaim
+	if rolesClaim == "" {
+		rolesClaim = defaultRolesClaim
+	}
+	p.Roles = claimAsStrings(claims[rolesClaim])
+	return p
+}
+
+// claimAsStrings converts a claim being either a space separated string or a list into a slice
+func claimAsStrings(claim any) []string {
+	switch v := claim.(type) {
+	case string:
+		return strings.Fields(v)
+	case []string:
+		return v
+	case []any:
+		values := make([]string, 0, len(v))
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return []string{}
+}
+
+// authorize checks the RequiredScopes and RequiredRoles of the controller against the
+// principal. The principal needs all of the required scopes and at least one of the
+// required roles. A JSONErrorResponse with code 403 is returned otherwise.
+func authorize(ctx *Context) error {
+	c := ctx.Controller
+	if len(c.RequiredScopes) == 0 && len(c.RequiredRoles) == 0 {
+		return nil
+	}
+	p := ctx.Principal()
+	if p == nil {
+		return newForbiddenError("no authenticated principal for controller %s", c.Name)
+	}
+	for _, scope := range c.RequiredScopes {
+		if !p.HasScope(scope) {
+			return newForbiddenError("%s lacks scope %s required by controller %s", p.Subject, scope, c.Name)
+		}
+	}
+	if len(c.RequiredRoles) > 0 && !slices.ContainsFunc(c.RequiredRoles, p.HasRole) {
+		return newForbiddenError("%s has none of the roles %v required by controller %s", p.Subject, c.RequiredRoles, c.Name)
+	}
+	return nil
+}
+
+func newForbiddenError(format string, args ...any) JSONErrorResponse {
+	return JSONErrorResponse{
+		Code:       http.StatusForbidden,
+		Message:    "forbidden",
+		LogMessage: fmt.Sprintf(format, args...),
+	}
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimitKey determines the bucket a request is counted in. Buckets are always
+// per controller, so the same key on different controllers doesn't share a limit.
+// Keys are determined after authentication, so they can depend on the principal.
+// Failed authentication attempts are charged to the key the request has without principal.
+type RateLimitKey func(ctx *Context) string
+
+// RateLimitByClientIP limits per client IP (see Context.ClientIP)
+func RateLimitByClientIP(ctx *Context) string {
+	return "ip:" + ctx.ClientIP()
+}
+
+// RateLimitBySubject limits per authenticated principal. Unauthenticated requests are
+// limited per client IP.
+func RateLimitBySubject(ctx *Context) string {
+	if p := ctx.Principal(); p != nil && p.Subject != "" {
+		return "subject:" + p.Subject
+	}
+	return RateLimitByClientIP(ctx)
+}
+
+// RateLimitByAPIKey limits per API key name for requests authenticated with an API key
+// and per client IP otherwise
+func RateLimitByAPIKey(ctx *Context) string {
+	if p := ctx.Principal(); p != nil && p.AuthMethod == AuthMethodAPIKey {
+		return "api_key:" + p.Subject
+	}
+	return RateLimitByClientIP(ctx)
+}
+
+// RateLimitBySubdomain limits per subdomain (see Context.Subdomain), e.g. per tenant
+func RateLimitBySubdomain(ctx *Context) string {
+	return "subdomain:" + ctx.Subdomain
+}
+
+// RateLimit allows Requests per Window using a token bucket holding Burst tokens.
+// The bucket refills continuously, so a client can't send 2*Requests around the
+// boundary of a window.
+type RateLimit struct {
+	Requests int
+	Window   time.Duration
+	Burst    int          // defaults to Requests
+	Key      RateLimitKey // defaults to RateLimitByClientIP
+}
+
+func (l RateLimit) burst() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return l.Requests
+}
+
+// tokensPerSecond is the refill rate of the bucket
+func (l RateLimit) tokensPerSecond() float64 {
+	return float64(l.Requests) / l.Window.Seconds()
+}
+
+// RateLimitResult is the outcome of RateLimitStore.Take
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int           // size of the bucket
+	Remaining  int           // tokens left after this request
+	Reset      time.Duration // until the bucket is full again
+	RetryAfter time.Duration // until the next token is available if the request wasn't allowed
+}
+
+// RateLimitStore holds the state of the rate limits. The default MemoryRateLimitStore
+// limits per instance. Implement it on top of a shared store to limit across instances.
+type RateLimitStore interface {
+	// Take consumes one token of the bucket with the given key if available
+	Take(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error)
+}
+
+// MemoryRateLimitStore keeps the buckets in memory. Full buckets are removed regularly.
+// The zero value is ready to use.
+type MemoryRateLimitStore struct {
+	mutex     sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Time // time the bucket is full again and can be removed
+}
+
+const rateLimitSweepInterval = time.Minute
+
+// NewMemoryRateLimitStore creates an empty store
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Take implements RateLimitStore
+func (m *MemoryRateLimitStore) Take(_ context.Context, key string, limit RateLimit) (RateLimitResult, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.buckets == nil {
+		m.buckets = make(map[string]*tokenBucket)
+	}
+	now := time.Now()
+	m.sweep(now)
+
+	burst := float64(limit.burst())
+	rate := limit.tokensPerSecond()
+	b, exists := m.buckets[key]
+	if !exists {
+		b = &tokenBucket{tokens: burst, last: now}
+		m.buckets[key] = b
+	} else {
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+		b.last = now
+	}
+
+	result := RateLimitResult{Limit: limit.burst()}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = secondsToDuration((1 - b.tokens) / rate)
+	}
+	result.Remaining = int(b.tokens)
+	result.Reset = secondsToDuration((burst - b.tokens) / rate)
+	b.full = now.Add(result.Reset)
+	return result, nil
+}
+
+// sweep removes buckets which are full again. Must be called holding the mutex.
+func (m *MemoryRateLimitStore) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	m.lastSweep = now
+	for key, b := range m.buckets {
+		if !now.Before(b.full) {
+			delete(m.buckets, key)
+		}
+	}
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// SetRateLimitStore replaces the default MemoryRateLimitStore. Must be called before
+// the server is started.
+func (s *Server) SetRateLimitStore(store RateLimitStore) {
+	s.rateLimitStore = store
+}
+
+func (s *Server) getRateLimitStore() RateLimitStore {
+	s.rateLimitOnce.Do(func() {
+		if s.rateLimitStore == nil {
+			s.rateLimitStore = NewMemoryRateLimitStore()
+		}
+	})
+	return s.rateLimitStore
+}
+
+// rateLimitKey returns the bucket of the request
+func (ctx *Context) rateLimitKey() string {
+	key := ctx.Controller.RateLimit.Key
+	if key == nil {
+		key = RateLimitByClientIP
+	}
+	return ctx.Controller.Name + "|" + key(ctx)
+}
+
+// checkRateLimit takes a token from the given bucket and sets the RateLimit headers.
+// Returns a JSONErrorResponse with code 429 if the limit is exceeded. Errors of the store
+// are logged and the request is let through.
+func (s *Server) checkRateLimit(ctx *Context, key string) error {
+	c := ctx.Controller
+	result, err := s.getRateLimitStore().Take(ctx.Request.Context(), key, *c.RateLimit)
+	if err != nil {
+		ctx.Logger().Error("Error checking rate limit, letting request pass", slog.String("error", err.Error()))
+		return nil
+	}
+	ctx.SendResponseHeader("RateLimit-Limit", strconv.Itoa(result.Limit))
+	ctx.SendResponseHeader("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	ctx.SendResponseHeader("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+	if result.Allowed {
+		return nil
+	}
+	ctx.SendResponseHeader("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+	return JSONErrorResponse{
+		Code:       http.StatusTooManyRequests,
+		Message:    "too_many_requests",
+		LogMessage: fmt.Sprintf("rate limit of controller %s exceeded", c.Name),
+	}
+}
+
+// enforceRateLimit rejects the request if the limit of the bucket is exceeded. Returns
+// false if the request must not be processed further.
+func (s *Server) enforceRateLimit(ctx *Context, key string) bool {
+	err := s.checkRateLimit(ctx, key)
+	if err == nil {
+		return true
+	}
+	s.countRateLimited(ctx)
+	ctx.SendJsonError(err)
+	return false
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrServiceNotFound is returned when resolving a service that has not been registered
+var ErrServiceNotFound = errors.New("service not found")
+
+// serviceEntry is a registered service. Either value is set right away or it is
+// constructed by the factory on first use.
+type serviceEntry struct {
+	name        string
+	value       any
+	factory     func(s *Server) (any, error)
+	once        sync.Once
+	constructed atomic.Bool
+	err         error
+	dependsOn   []reflect.Type
+}
+
+// serviceRegistry holds all services of a server. Services registered through the
+// generic functions are keyed by their type, the ones from RegisterService by name.
+type serviceRegistry struct {
+	mutex   sync.RWMutex
+	entries map[any]*serviceEntry
+	order   []*serviceEntry
+}
+
+// ServiceOption customizes the registration of a service
+type ServiceOption func(entry *serviceEntry)
+
+// DependsOn declares that a service requires the service of type T. Dependencies are
+// validated on startup, so missing services are detected before the first request.
+func DependsOn[T any]() ServiceOption {
+	return func(entry *serviceEntry) {
+		entry.dependsOn = append(entry.dependsOn, reflect.TypeFor[T]())
+	}
+}
+
+// Provide registers the service under its type T. To register an implementation
+// under an interface, specify the type explicitly: server.Provide[Greeter](s, &greeter{})
+func Provide[T any](s *Server, service T, opts ...ServiceOption) {
+	t := reflect.TypeFor[T]()
+	s.getServiceRegistry().add(t, newServiceEntry(t.String(), service, nil, opts))
+}
+
+// ProvideLazy registers a factory that constructs the service of type T on first use.
+// The instance is then kept as singleton. Services required by the factory must be
+// declared with DependsOn. Lazily constructed services don't take part in the start
+// hooks, but are stopped if they were constructed and implement StopHook.
+func ProvideLazy[T any](s *Server, factory func(s *Server) (T, error), opts ...ServiceOption) {
+	t := reflect.TypeFor[T]()
+	f := func(s *Server) (any, error) {
+		return factory(s)
+	}
+	s.getServiceRegistry().add(t, newServiceEntry(t.String(), nil, f, opts))
+}
+
+// Resolve returns the service of type T. The returned error wraps ErrServiceNotFound
+// if no such service was registered.
+func Resolve[T any](ctx *Context) (T, error) {
+	return ResolveFromServer[T](ctx.Server)
+}
+
+// MustResolve is like Resolve but panics if the service can't be resolved
+func MustResolve[T any](ctx *Context) T {
+	service, err := Resolve[T](ctx)
+	if err != nil {
+		panic(err)
+	}
+	return service
+}
+
+// ResolveFromServer returns the service of type T outside of a request, e.g. in
+// a factory of ProvideLazy.
+func ResolveFromServer[T any](s *Server) (T, error) {
+	var empty T
+	t := reflect.TypeFor[T]()
+	service, err := s.getServiceRegistry().resolve(t, s)
+	if err != nil {
+		return empty, err
+	}
+	typed, ok := service.(T)
+	if !ok {
+		return empty, fmt.Errorf("service registered as %s is of unexpected type %T", t, service)
+	}
+	return typed, nil
+}
+
+// ValidateServices checks that all declared dependencies are registered and that
+// there are no cyclic dependencies. It's called automatically when the server starts.
+func (s *Server) ValidateServices() error {
+	return s.getServiceRegistry().validate()
+}
+
+func newServiceRegistry() *serviceRegistry {
+	return &serviceRegistry{entries: make(map[any]*serviceEntry)}
+}
+
+func (s *Server) getServiceRegistry() *serviceRegistry {
+	return s.services
+}
+
+func newServiceEntry(name string, value any, factory func(s *Server) (any, error), opts []ServiceOption) *serviceEntry {
+	entry := &serviceEntry{
+		name:    name,
+		value:   value,
+		factory: factory,
+	}
+	for _, opt := range opts {
+		opt(entry)
+	}
+	return entry
+}
+
+func (r *serviceRegistry) add(key any, entry *serviceEntry) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	existing, exists := r.entries[key]
+	r.entries[key] = entry
+	if !exists {
+		r.order = append(r.order, entry)
+		return
+	}
+	for i, e := range r.order {
+		if e == existing {
+			r.order[i] = entry
+		}
+	}
+}
+
+func (r *serviceRegistry) resolve(key any, s *Server) (any, error) {
+	r.mutex.RLock()
+	entry, ok := r.entries[key]
+	r.mutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", ErrServiceNotFound, key)
+	}
+	return entry.get(s)
+}
+
+func (e *serviceEntry) get(s *Server) (any, error) {
+	if e.factory == nil {
+		return e.value, nil
+	}
+	e.once.Do(func() {
+		e.value, e.err = e.factory(s)
+		if e.err != nil {
+			e.err = fmt.Errorf("error constructing service %s: %w", e.name, e.err)
+			return
+		}
+		e.constructed.Store(true)
+	})
+	return e.value, e.err
+}
+
+// getServices returns all services in registration order. Lazy services are only
+// included if includeLazy is set and they have been constructed already.
+func (r *serviceRegistry) getServices(includeLazy bool) []any {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	services := []any{}
+	for _, entry := range r.order {
+		if entry.factory != nil && (!includeLazy || !entry.constructed.Load()) {
+			continue
+		}
+		services = append(services, entry.value)
+	}
+	return services
+}
+
+func (r *serviceRegistry) validate() error {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	errs := []error{}
+	for _, entry := range r.order {
+		for _, dep := range entry.dependsOn {
+			if _, ok := r.entries[dep]; !ok {
+				errs = append(errs, fmt.Errorf("service %s depends on %s: %w", entry.name, dep, ErrServiceNotFound))
+			}
+		}
+	}
+
+	// detect cycles with a depth first search
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := map[*serviceEntry]int{}
+	var visit func(entry *serviceEntry, path []string) error
+	visit = func(entry *serviceEntry, path []string) error {
+		path = append(path, entry.name)
+		switch state[entry] {
+		case visiting:
+			return fmt.Errorf("cyclic service dependency: %s", strings.Join(path, " -> "))
+		case done:
+			return nil
+		}
+		state[entry] = visiting
+		for _, dep := range entry.dependsOn {
+			depEntry, ok := r.entries[dep]
+			if !ok {
+				continue
+			}
+			err := visit(depEntry, path)
+			if err != nil {
+				return err
+			}
+		}
+		state[entry] = done
+		return nil
+	}
+	for _, entry := range r.order {
+		err := visit(entry, []string{})
+		if err != nil {
+			errs = append(errs, err)
+			break
+		}
+	}
+	return errors.Join(errs...)
+}
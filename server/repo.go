@@ -1,8 +1,10 @@
 package server
 
 import (
+	"context"
 	"fmt"
 
+	"go.opentelemetry.io/otel/trace"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
 )
@@ -17,6 +19,7 @@ const (
 type Repository struct {
 	DB       *gorm.DB
 	dbConfig DBconfig
+	tracer   trace.Tracer
 }
 
 // DBconfig holds all relevant db configurations
@@ -82,3 +85,21 @@ func (r *Repository) RunMigrations(entities []interface{}) {
 		r.DB.AutoMigrate(e)
 	}
 }
+
+// OnStop closes the DB connection pool once the server has been shut down
+func (r *Repository) OnStop(ctx context.Context) error {
+	db, err := r.DB.DB()
+	if err != nil {
+		return fmt.Errorf("failed to retrieve underlying sqldb object: %w", err)
+	}
+	return db.Close()
+}
+
+// CheckHealth pings the DB
+func (r *Repository) CheckHealth(ctx context.Context) error {
+	db, err := r.DB.DB()
+	if err != nil {
+		return fmt.Errorf("failed to retrieve underlying sqldb object: %w", err)
+	}
+	return db.PingContext(ctx)
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SendStream copies r to the response without buffering it. Without a Content-Length header
+// set before, the response is sent chunked. Every chunk is flushed, so content produced
+// slowly by r reaches the client right away. The server writeTimeout applies per chunk instead
+// of to the whole response. Returns the error of r or of writing to the client.
+func (ctx *Context) SendStream(code int, contentType string, r io.Reader) error {
+	w, err := ctx.startStreamedResponse()
+	if err != nil {
+		return err
+	}
+	w.flush = true
+	ctx.SendResponseHeader("Content-Type", contentType)
+	ctx.sendCode(code)
+	_, err = io.Copy(w, r)
+	if err != nil {
+		return fmt.Errorf("error while streaming response: %w", err)
+	}
+	return nil
+}
+
+// SendFile sends the file at the given path using SendContent. The ETag is derived from the
+// modification time and size unless set before. Missing files result in a 404
+// JSONErrorResponse. The path must not be taken from the request unchecked.
+func (ctx *Context) SendFile(path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fileNotFound(path)
+	}
+	if err != nil {
+		return fmt.Errorf("error opening file %s: %w", path, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("error reading file info of %s: %w", path, err)
+	}
+	if info.IsDir() {
+		return fileNotFound(path)
+	}
+	if ctx.responseWriter != nil && ctx.responseWriter.Header().Get("ETag") == "" {
+		ctx.SendResponseHeader("ETag", fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()))
+	}
+	return ctx.SendContent(filepath.Base(path), info.ModTime(), f)
+}
+
+// SendContent sends content with support for range requests (Range, If-Range) and
+// conditional requests (If-Modified-Since, If-None-Match with an ETag header set before).
+// The content type is derived from the extension of name unless set before. The server
+// writeTimeout applies per chunk instead of to the whole response. See http.ServeContent.
+func (ctx *Context) SendContent(name string, modtime time.Time, content io.ReadSeeker) error {
+	w, err := ctx.startStreamedResponse()
+	if err != nil {
+		return err
+	}
+	http.ServeContent(w, ctx.Request, name, modtime, content)
+	return nil
+}
+
+func fileNotFound(path string) JSONErrorResponse {
+	return JSONErrorResponse{
+		Code:       http.StatusNotFound,
+		Message:    "not_found",
+		LogMessage: fmt.Sprintf("file %s doesn't exist", path),
+	}
+}
+
+func (ctx *Context) startStreamedResponse() (*streamWriter, error) {
+	if ctx.IsResponseSent {
+		return nil, errors.New("response for this request was already sent")
+	}
+	if ctx.responseWriter == nil {
+		return nil, errors.New("no response writer to stream to")
+	}
+	ctx.IsResponseSent = true
+	return &streamWriter{
+		ResponseWriter: ctx.responseWriter,
+		rc:             http.NewResponseController(ctx.responseWriter),
+		writeTimeout:   ctx.Server.writeTimeout,
+	}, nil
+}
+
+// streamWriter extends the write deadline before every write, so large responses aren't
+// cut off by the writeTimeout of the server
+type streamWriter struct {
+	http.ResponseWriter
+	rc           *http.ResponseController
+	writeTimeout time.Duration
+	flush        bool
+}
+
+func (w *streamWriter) Write(b []byte) (int, error) {
+	if w.writeTimeout > 0 {
+		err := w.rc.SetWriteDeadline(time.Now().Add(w.writeTimeout))
+		if err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return 0, err
+		}
+	}
+	n, err := w.ResponseWriter.Write(b)
+	if err != nil || !w.flush {
+		return n, err
+	}
+	err = w.rc.Flush()
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return n, err
+	}
+	return n, nil
+}
@@ -1,24 +1,26 @@
 package server
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
-	"io"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"runtime/debug"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	jwtmiddleware "github.com/auth0/go-jwt-middleware"
-	"github.com/form3tech-oss/jwt-go"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
 
 	"net/http/httptest"
 	_ "net/http/pprof"
@@ -32,10 +34,20 @@ const (
 	ConfigLogLevel         = "loglevel"
 	ConfigEnableProfiling  = "enable_profiling"
 	ConfigEnablePrometheus = "enable_prometheus"
+	ConfigShutdownTimeout  = "shutdownTimeout"
+	ConfigLogFormat        = "log_format"
+	// ConfigControllerLogLevels overrides the log level per controller: ControllerA:debug,ControllerB:warn
+	ConfigControllerLogLevels = "loglevel_controllers"
 )
 
-var (
-	promHttpHist *prometheus.HistogramVec
+// HeaderRequestID carries the request id. It's taken from incoming requests, set on
+// all responses and forwarded by the client returned from Context.HTTPClient.
+const HeaderRequestID = "X-Request-ID"
+
+// Metric names maintained by the server itself
+const (
+	MetricPanics      = "controller_panics"
+	MetricRateLimited = "rate_limited_requests"
 )
 
 // Server Generic server who is able to load a list of controllers from
@@ -45,11 +57,49 @@ type Server struct {
 	controllers         []Controller
 	statusInfo          *StatusInformation
 	repository          *Repository
-	serviceMap          map[string]interface{}
+	services            *serviceRegistry
+	controllerProviders []ControllerProvider
 	requestHandler      http.Handler
-	LogLevel            string
+	middlewares         []Middleware
+	logHandler          slog.Handler
+	logger              *slog.Logger
+	logLevels           *logLevels
+	router              *mux.Router
 	pathPrefix          string
-	isPrometheusEnabled bool
+	metrics             *serverMetrics
+	lifecycleMutex      sync.Mutex
+	httpSrv             *http.Server
+	stopped             chan struct{}
+	shutdownOnce        sync.Once
+	shutdownErr         error
+	shuttingDown        atomic.Bool
+	healthChecks        []healthCheck
+	tracer              trace.Tracer
+	tracerProvider      *sdktrace.TracerProvider // created from the config, shut down with the server
+	jwksMutex           sync.Mutex
+	jwksProviders       map[string]*JWKSProvider // by issuer
+	jwksConfig          jwksConfig
+	cors                *CORSOptions
+	preflightRoutes     map[string]*preflightRoute // by controller path
+	rateLimitStore      RateLimitStore
+	rateLimitOnce       sync.Once
+	trustProxyHeaders   bool
+	proxyHops           int
+	maxBodySize         int64 // 0 meaning unlimited
+	webSocketOptions    webSocketOptions
+	healthCheckTimeout  time.Duration // 0 meaning the default
+	httpClientTimeout   time.Duration
+	writeTimeout        time.Duration
+	sseHeartbeat        time.Duration // 0 meaning the default
+	jwtScopesClaim      string
+	jwtRolesClaim       string
+	jwtClockSkew        time.Duration
+	baseDomains         []string
+	tenantResolver      TenantResolver
+	streamStop          chan struct{} // closed on shutdown to end SSE streams
+	streamStopOnce      sync.Once
+	webSockets          sync.WaitGroup // running WebSocket handlers, not drained by http.Server
+	stopStreamsOnce     sync.Once
 }
 
 // GetControllers returns all controllers of the controller provider
@@ -64,14 +114,68 @@ func CreateServer(config Config, ctrProviders []ControllerProvider) *Server {
 	return CreateServerWithPrefix(config, ctrProviders, "")
 }
 func BlankServer() *Server {
-	return &Server{serviceMap: make(map[string]interface{})}
+	return &Server{services: newServiceRegistry()}
 }
 func CreateServerWithPrefix(config Config, ctrProviders []ControllerProvider, pathPrefix string) *Server {
 	server := Server{
-		config:      config,
-		controllers: []Controller{},
-		statusInfo:  CreateStatusInfo(),
-		pathPrefix:  pathPrefix,
+		config:              config,
+		controllers:         []Controller{},
+		controllerProviders: ctrProviders,
+		statusInfo:          CreateStatusInfo(),
+		services:            newServiceRegistry(),
+		pathPrefix:          pathPrefix,
+	}
+
+	err := server.loadLogLevel(config)
+	if err != nil {
+		log.Panic(err)
+	}
+	server.SetLogHandler(newLogHandler(config.Get(ConfigLogFormat), os.Stderr))
+	for _, domain := range splitConfigList(config.Get(ConfigBaseDomains)) {
+		server.baseDomains = append(server.baseDomains, strings.ToLower(domain))
+	}
+	server.cors, err = loadCORSOptions(config)
+	if err != nil {
+		log.Panic(err)
+	}
+	server.jwksConfig, err = loadJWKSConfig(config)
+	if err != nil {
+		log.Panic(err)
+	}
+	server.trustProxyHeaders = config.Get(ConfigTrustProxyHeaders) == "true"
+	server.proxyHops, err = loadProxyHops(config)
+	if err != nil {
+		log.Panic(err)
+	}
+	server.maxBodySize, err = loadMaxRequestBodySize(config)
+	if err != nil {
+		log.Panic(err)
+	}
+	server.webSocketOptions, err = loadWebSocketOptions(config)
+	if err != nil {
+		log.Panic(err)
+	}
+	server.healthCheckTimeout, err = loadHealthCheckTimeout(config)
+	if err != nil {
+		log.Panic(err)
+	}
+	server.httpClientTimeout, err = config.GetDuration(ConfigHTTPClientTimeout)
+	if err != nil {
+		log.Panic(err)
+	}
+	server.writeTimeout, err = config.GetDuration(ConfigWriteTimeout)
+	if err != nil {
+		log.Panic(err)
+	}
+	server.sseHeartbeat, err = loadSSEHeartbeatInterval(config)
+	if err != nil {
+		log.Panic(err)
+	}
+	server.jwtScopesClaim = config.Get(ConfigJWTScopesClaim)
+	server.jwtRolesClaim = config.Get(ConfigJWTRolesClaim)
+	server.jwtClockSkew, err = config.GetDuration(ConfigJWTClockSkew)
+	if err != nil {
+		log.Panic(err)
 	}
 
 	r := mux.NewRouter()
@@ -79,6 +183,7 @@ func CreateServerWithPrefix(config Config, ctrProviders []ControllerProvider, pa
 	if len(pathPrefix) > 0 {
 		s = r.PathPrefix(pathPrefix).Subrouter()
 	}
+	server.router = s
 
 	for _, ctrProv := range ctrProviders {
 		ctrList := ctrProv.GetControllers()
@@ -89,78 +194,85 @@ func CreateServerWithPrefix(config Config, ctrProviders []ControllerProvider, pa
 	}
 
 	server.registerController(s, StatusController)
+	server.registerController(s, HealthzController)
+	server.registerController(s, ReadyzController)
+	err = server.loadControllerLogLevels(config)
+	if err != nil {
+		log.Panic(err)
+	}
 
 	prof := config.Get(ConfigEnableProfiling)
 	if prof == "true" {
 		s.PathPrefix("/debug/pprof/").Handler(http.DefaultServeMux)
-		log.Println("Enabled profiling endpoints on /debug/pprof/")
+		server.logger.Info("Enabled profiling endpoints", slog.String("path", pathPrefix+"/debug/pprof/"))
 	}
 
 	prom := config.Get(ConfigEnablePrometheus)
 	if prom == "true" {
-		server.isPrometheusEnabled = true
-		promHttpHist = promauto.NewHistogramVec(prometheus.HistogramOpts{
-			Name:    "ssf_server_controller_requestcount",
-			Help:    "Counts the number of controller invokations",
-			Buckets: []float64{1, 10, 50, 100, 200, 400, 800, 1500, 3000, 10000, 30000, 60000},
-		}, []string{"controller"})
-
-		s.Handle("/metrics", promhttp.Handler())
-		log.Printf("Enabled prometheus metrics endpoint on %s/metrics", pathPrefix)
+		server.metrics = newServerMetrics(server.statusInfo)
+		s.Handle("/metrics", server.getMetricsHandler())
+		server.logger.Info("Enabled prometheus metrics endpoint", slog.String("path", pathPrefix+"/metrics"))
 	}
 
-	s.NotFoundHandler = getNotFoundHandler()
-	server.requestHandler = r
-
-	server.serviceMap = make(map[string]interface{})
-
-	ll := config.Get(ConfigLogLevel)
-	if ll == "" {
-		ll = LogLevelInfo
-	} else if (strings.ToLower(ll) != LogLevelDebug) && (strings.ToLower(ll) != LogLevelInfo) {
-		log.Panicf("Invalid loglevel provided. Expecting %s or %s", LogLevelDebug, LogLevelInfo)
+	tp, err := CreateTracerProvider(config)
+	if err != nil {
+		log.Panic(err)
+	}
+	if tp != nil {
+		server.tracerProvider = tp
+		server.EnableTracing(tp)
+		server.logger.Info("Enabled tracing", slog.String("exporter", config.Get(ConfigTracingExporter)))
 	}
 
-	server.LogLevel = ll
+	s.NotFoundHandler = server.getNotFoundHandler()
+	server.requestHandler = withRequestID(r)
 	return &server
 }
 
-// SetRepository sets the repository if one is being used.
+// SetRepository sets the repository if one is being used. The repository is added
+// to the readiness checks and its queries are traced if tracing is enabled.
 func (s *Server) SetRepository(repo *Repository) {
 	s.repository = repo
+	if repo == nil {
+		return
+	}
+	s.RegisterHealthCheck("repository", repo)
+	if s.tracer != nil {
+		err := repo.enableTracing(s.tracer)
+		if err != nil {
+			s.Logger().Error("Error enabling tracing of the repository: " + err.Error())
+		}
+	}
 }
 
 func (s *Server) GetRepository() *Repository {
 	return s.repository
 }
 
-// RegisterService registers a service to the server
+// RegisterService registers a service to the server by name. Services implementing
+// StartHook or StopHook take part in the server lifecycle in registration order.
+// Prefer the type safe Provide and Resolve functions.
 func (s *Server) RegisterService(name string, service interface{}) {
-	s.serviceMap[name] = service
+	s.getServiceRegistry().add(name, newServiceEntry(name, service, nil, nil))
 }
 
+// GetService returns the service registered with the given name or nil if there is none.
 func (s *Server) GetService(name string) interface{} {
-	return s.serviceMap[name]
+	service, err := s.getServiceRegistry().resolve(name, s)
+	if err != nil {
+		s.Logger().Error(err.Error())
+		return nil
+	}
+	return service
 }
 
-// Start starts the previously initialized server
+// Start starts the previously initialized server and blocks until the process
+// receives SIGINT or SIGTERM. See Run for more control over the lifecycle.
 func (s *Server) Start() {
-
-	port := s.config.Get(ConfigPort)
-	rt, err1 := s.config.GetDuration(ConfigReadTimeout)
-	wt, err2 := s.config.GetDuration(ConfigWriteTimeout)
-	if err1 != nil || err2 != nil {
-		panic(fmt.Sprintf("%s, %s", err1, err2))
-	}
-	httpSrv := &http.Server{
-		Addr:         fmt.Sprintf(":%s", port),
-		ReadTimeout:  rt,
-		WriteTimeout: wt,
-		Handler:      s.requestHandler,
+	if err := s.Run(context.Background()); err != nil {
+		s.Logger().Error("Server stopped with error", slog.String("error", err.Error()))
+		os.Exit(1)
 	}
-
-	log.Printf("Starting listening on port: %s", port)
-	log.Fatal(httpSrv.ListenAndServe())
 }
 
 // GetMainHandler Gives access to the mux router for testing purposes
@@ -168,12 +280,48 @@ func (s *Server) GetMainHandler() http.Handler {
 	return s.requestHandler
 }
 
+type requestIDKey struct{}
+
+// withRequestID sets the request id on all responses, including those the router sends
+// without invoking a controller like 404, 405 and preflight responses
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqID := requestIDOf(r)
+		w.Header().Set(HeaderRequestID, reqID)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, reqID)))
+	})
+}
+
+// requestIDOf returns the request id assigned by withRequestID, the one sent by the
+// caller or a new one
+func requestIDOf(r *http.Request) string {
+	if reqID, ok := r.Context().Value(requestIDKey{}).(string); ok {
+		return reqID
+	}
+	if reqID := r.Header.Get(HeaderRequestID); reqID != "" {
+		return reqID
+	}
+	return uuid.New().String()
+}
+
 // initContext initialzes the context for the given request
 func (s *Server) initContext(w http.ResponseWriter, r *http.Request, c Controller) *Context {
-	reqID := r.Header.Get("X-Request-ID")
-	if reqID == "" {
-		reqID = uuid.New().String()
+	reqID := requestIDOf(r)
+	if w != nil {
+		w.Header().Set(HeaderRequestID, reqID)
+	}
+
+	route := c.Path
+	if cr := mux.CurrentRoute(r); cr != nil {
+		tpl, err := cr.GetPathTemplate()
+		if err == nil {
+			route = tpl
+		}
+	}
+	if route == "" {
+		route = r.URL.Path
 	}
+	r = extractTraceContext(r)
 
 	context := &Context{
 		Server:             s,
@@ -181,12 +329,21 @@ func (s *Server) initContext(w http.ResponseWriter, r *http.Request, c Controlle
 		responseWriter:     w,
 		StatusInformation:  s.statusInfo,
 		Repository:         s.repository,
-		serviceMap:         s.serviceMap,
-		LogLevel:           s.LogLevel,
 		ControllerProvider: c.controllerProvider,
 		Controller:         &c,
+		Route:              route,
+		Subdomain:          s.extractSubdomain(r),
 	}
 	context.SetRequestID(reqID)
+	context.logger = s.newLogger(c.Name).With(
+		slog.String(ContextKeyRequestID, reqID),
+		slog.String("controller", c.Name),
+		slog.String("method", r.Method),
+		slog.String("route", route),
+	)
+	if context.Subdomain != "" {
+		context.logger = context.logger.With(slog.String("tenant", context.Subdomain))
+	}
 	return context
 }
 
@@ -198,191 +355,159 @@ func (s *Server) InitNonRequestContext() *Context {
 }
 
 func (s *Server) registerController(r *mux.Router, c Controller) {
+	if !c.IsSecured && (len(c.RequiredScopes) > 0 || len(c.RequiredRoles) > 0) {
+		log.Panicf("controller %s requires scopes or roles but isn't secured", c.Name)
+	}
+	if c.WebSocketFunc != nil && (c.ControllerFunc != nil || !slices.Equal(c.Methods, []string{http.MethodGet})) {
+		log.Panicf("WebSocket controller %s must only have the method GET and no ControllerFunc", c.Name)
+	}
+	if c.CORS != nil {
+		if err := c.CORS.validate(); err != nil {
+			log.Panicf("invalid CORS options of controller %s: %s", c.Name, err.Error())
+		}
+	}
+	if c.RateLimit != nil && (c.RateLimit.Requests <= 0 || c.RateLimit.Window <= 0) {
+		log.Panicf("rate limit of controller %s needs positive Requests and Window", c.Name)
+	}
 	s.controllers = append(s.controllers, c)
 
 	ctrHandler := http.HandlerFunc(s.getControllerHandlerFunc(c))
+	var route *mux.Route
 	if c.HandlesSubpaths {
 		prefix := fmt.Sprintf("%s/", c.Path)
 		if len(s.pathPrefix) > 0 {
 			prefix = fmt.Sprintf("%s%s", s.pathPrefix, c.Path)
 		}
-		r.PathPrefix(c.Path).Handler(http.StripPrefix(prefix, ctrHandler)).Methods(c.Methods...)
+		route = r.PathPrefix(c.Path).Handler(http.StripPrefix(prefix, ctrHandler)).Methods(c.Methods...)
 	} else {
-		r.Handle(c.Path, ctrHandler).Methods(c.Methods...)
+		route = r.Handle(c.Path, ctrHandler).Methods(c.Methods...)
+	}
+	if len(c.Subdomains) > 0 {
+		route.MatcherFunc(s.matchesSubdomains(c))
 	}
-	log.Printf("Registered controller %s", c.Name)
+	s.registerPreflight(r, c)
+	s.Logger().Info("Registered controller", slog.String("controller", c.Name), slog.String("path", c.Path))
 }
 
 func (s *Server) getControllerHandlerFunc(c Controller) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now().UnixNano()
-		ctx := s.initContext(w, r, c)
+		start := time.Now()
+		rw := &responseWriter{ResponseWriter: w}
+		ctx := s.initContext(rw, r, c)
+		s.setCORSHeaders(rw, r, &c)
+		span := ctx.startControllerSpan()
+		if s.metrics != nil {
+			s.metrics.inFlight.Inc()
+			defer s.metrics.inFlight.Dec()
+		}
 		ctx.LogDebug(fmt.Sprintf("Executing %s for request: %s", c.Name, r.RequestURI))
-		if c.IsSecured {
-			err := c.AuthFunc(ctx)
-			if err != nil {
-				if ctx.IsResponseSent {
-					ctx.LogError(fmt.Sprintf("Authentication for controller %s failed with code: %d: %s", c.Name, ctx.ResponseCode, err.Error()))
-					return
-				}
-				ctx.SendJsonError(JSONErrorResponse{
-					Code:       http.StatusUnauthorized,
-					Message:    "unauthorized",
-					LogMessage: fmt.Sprintf("Authentication for controller %s failed: %s", c.Name, err.Error()),
-				})
-				return
+		func() {
+			defer s.recoverPanic(ctx)
+			if s.resolveTenant(ctx) && s.limitRequestBody(ctx, w) {
+				runMiddlewares(ctx, s.getMiddlewares(&c), authenticateAndExecute)
 			}
+		}()
+		if ctx.stream != nil {
+			ctx.stream.Close()
 		}
-		c.Execute(ctx)
-		duration := time.Now().UnixNano() - start
-		ctx.LogDebug(formatExecLogMessage(r, duration, ctx.ResponseCode))
-		if s.isPrometheusEnabled {
-			observed := float64(duration) / 1000000 // calc in ms
-			promHttpHist.With(prometheus.Labels{"controller": c.Name}).Observe(observed)
+		if ctx.ResponseCode == 0 {
+			ctx.ResponseCode = rw.code
 		}
+		ctx.endControllerSpan(span)
+		duration := time.Since(start)
+		ctx.log(slog.LevelDebug, "Request processed", slog.Int("status", ctx.ResponseCode), slog.Duration("duration", duration))
+		s.observeRequest(ctx, duration, rw.written)
 	}
 }
 
-func formatExecLogMessage(r *http.Request, duration int64, code int) string {
-	uri := r.URL.String()
-	method := r.Method
-	return fmt.Sprintf("%s %s: processing duration: %d ns, returned code: %d", method, uri, duration, code)
-}
-
-func getNotFoundHandler() http.Handler {
-	fn := func(w http.ResponseWriter, r *http.Request) {
-		code := http.StatusNotFound
-		log.Println(formatExecLogMessage(r, 0, code) + " NOT FOUND")
-		w.WriteHeader(code)
-		fmt.Fprint(w, "Not Found!")
+// recoverPanic recovers panics of controllers, auth functions and middlewares
+// and sends a 500 error response unless a response was sent already.
+// Must be called deferred.
+func (s *Server) recoverPanic(ctx *Context) {
+	rec := recover()
+	if rec == nil {
+		return
 	}
-
-	// http.HandlerFunc wraps a function so that it
-	// implements http.Handler interface
-	return http.HandlerFunc(fn)
-}
-
-func GetJwtAuth(issuer string, customValidator func(claims jwt.MapClaims) error) func(ctx *Context) error {
-	jmw := getJWTMiddlewareHandler(issuer, customValidator, jwtmiddleware.FromAuthHeader)
-	return func(ctx *Context) error {
-		err := jmw.CheckJWT(httptest.NewRecorder(), ctx.Request)
-		return err
+	if rec == http.ErrAbortHandler {
+		// deliberate abort of the response, let net/http handle it
+		panic(rec)
 	}
-}
-func GetJwtAuthFromQuery(issuer string, customValidator func(claims jwt.MapClaims) error, parameterName string) func(ctx *Context) error {
-	jmw := getJWTMiddlewareHandler(issuer, customValidator, jwtmiddleware.FromParameter(parameterName))
-	return func(ctx *Context) error {
-		err := jmw.CheckJWT(httptest.NewRecorder(), ctx.Request)
-		return err
+	ctx.LogErrorf("Recovered from panic in controller %s: %v\n%s", ctx.Controller.Name, rec, debug.Stack())
+	ctx.StatusInformation.IncrementMetric(MetricPanics)
+	if s.metrics != nil {
+		s.metrics.panics.With(prometheus.Labels{"controller": ctx.Controller.Name}).Inc()
 	}
-}
-
-func getJWTMiddlewareHandler(issuer string, customValidator func(claims jwt.MapClaims) error, extractor func(r *http.Request) (string, error)) *jwtmiddleware.JWTMiddleware {
-	jwtMiddleware := jwtmiddleware.New(jwtmiddleware.Options{
-		ValidationKeyGetter: func(token *jwt.Token) (interface{}, error) {
-			claims := token.Claims.(jwt.MapClaims)
-			if claims["iss"] != issuer {
-				msg := fmt.Sprintf("token has wrong issuer: %s", claims["iss"])
-				fmt.Println(msg)
-				return nil, errors.New(msg)
-			}
-
-			err := customValidator(claims)
-			if err != nil {
-				return nil, fmt.Errorf("custom claims validator returned error: %w", err)
-			}
-
-			cert, err := getPemCert(token)
-			if err != nil {
-				return nil, fmt.Errorf("unable to fetch token certificate with JWKS: %w", err)
-			}
-			result, err := jwt.ParseRSAPublicKeyFromPEM([]byte(cert))
-			if err != nil {
-				return nil, fmt.Errorf("error parsing public key from JWKS endpoint: %w", err)
-			}
-
-			return result, nil
-		},
-		SigningMethod: jwt.SigningMethodRS256,
-		Extractor:     extractor,
+	if ctx.IsResponseSent {
+		return
+	}
+	ctx.SendJsonError(JSONErrorResponse{
+		Code:       http.StatusInternalServerError,
+		Message:    "internal_server_error",
+		LogMessage: fmt.Sprintf("panic in controller %s: %v", ctx.Controller.Name, rec),
 	})
-	return jwtMiddleware
 }
 
-type keyMapEntry struct {
-	Expiration time.Time
-	JWKS       Jwks
-}
-
-// ok to cache globally as multiple server instance can share the same cache
-var keyMap map[string]keyMapEntry = make(map[string]keyMapEntry)
-var mutex sync.Mutex
-
-func getPemCert(token *jwt.Token) (string, error) {
-	cert := ""
-
-	claims := token.Claims.(jwt.MapClaims)
-	issuer, worked := claims["iss"].(string)
-	if !worked {
-		return "", fmt.Errorf("issuer doesn't seem to be a string %+v", token)
-	}
-	mutex.Lock()
-	defer mutex.Unlock()
-
-	entry, ok := keyMap[issuer]
-	if !ok || entry.Expiration.Before(time.Now()) {
-		log.Default().Printf("loading jwks of issuer %s", issuer)
-		url := issuer + ".well-known/jwks.json"
-
-		resp, err := http.Get(url)
-
-		if err != nil {
-			return "", fmt.Errorf("error fetching jwks for issuer %s: %w", claims["iss"].(string), err)
-		}
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return "", fmt.Errorf("error reading body of jwks response for issuer %s: %w", issuer, err)
+// authenticateAndExecute is the end of every middleware chain
+func authenticateAndExecute(ctx *Context) {
+	c := ctx.Controller
+	s := ctx.Server
+	limited := c.RateLimit != nil
+	if c.IsSecured {
+		// failed attempts are charged to the key the request has without principal
+		unauthenticatedKey := ""
+		if limited {
+			unauthenticatedKey = ctx.rateLimitKey()
 		}
-		var jwks = Jwks{}
-		err = json.Unmarshal(body, &jwks)
+		err := c.AuthFunc(ctx)
 		if err != nil {
-			return "", fmt.Errorf("error unmarshaling jwks: %w", err)
-		}
-		entry = keyMapEntry{
-			JWKS:       jwks,
-			Expiration: time.Now().Add(4 * time.Hour),
+			s.countAuthFailure(ctx, AuthFailureUnauthenticated)
+			if limited && !s.enforceRateLimit(ctx, unauthenticatedKey) {
+				return
+			}
+			if ctx.IsResponseSent {
+				ctx.LogError(fmt.Sprintf("Authentication for controller %s failed with code: %d: %s", c.Name, ctx.ResponseCode, err.Error()))
+				return
+			}
+			sendAuthChallenges(ctx, err)
+			// AuthFuncs may return a JSONErrorResponse to tell the caller why it failed
+			jerr := JSONErrorResponse{
+				Code:    http.StatusUnauthorized,
+				Message: "unauthorized",
+			}
+			errors.As(err, &jerr)
+			jerr.LogMessage = fmt.Sprintf("Authentication for controller %s failed: %s", c.Name, err.Error())
+			ctx.SendJsonError(jerr)
+			return
 		}
-		keyMap[issuer] = entry
 	}
-
-	jwks := entry.JWKS
-
-	for k := range jwks.Keys {
-		if token.Header["kid"] == jwks.Keys[k].Kid {
-			//			fmt.Printf("JWKS endpoint result: found kid: %s\n", jwks.Keys[k].Kid)
-			cert = "-----BEGIN CERTIFICATE-----\n" + jwks.Keys[k].X5c[0] + "\n-----END CERTIFICATE-----"
-		}
+	if limited && !s.enforceRateLimit(ctx, ctx.rateLimitKey()) {
+		return
 	}
-
-	if cert == "" {
-		err := fmt.Errorf("unable to find appropriate key %s in jwks %+v for token %+v. Keymap entry: %+v", token.Header["kid"], jwks, token, entry)
-		return cert, err
+	if c.IsSecured {
+		err := authorize(ctx)
+		if err != nil {
+			s.countAuthFailure(ctx, AuthFailureForbidden)
+			ctx.SendJsonError(err)
+			return
+		}
 	}
-
-	return cert, nil
+	c.Execute(ctx)
 }
 
-// Jwks used to marshal the key response from Auth0
-type Jwks struct {
-	Keys []JSONWebKeys `json:"keys"`
-}
+func (s *Server) getNotFoundHandler() http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		code := http.StatusNotFound
+		s.Logger().Info("Not found",
+			slog.String(ContextKeyRequestID, requestIDOf(r)),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", code),
+		)
+		w.WriteHeader(code)
+		fmt.Fprint(w, "Not Found!")
+	}
 
-// JSONWebKeys used to marshal the key response from Auth0
-type JSONWebKeys struct {
-	Kty string   `json:"kty"`
-	Kid string   `json:"kid"`
-	Use string   `json:"use"`
-	N   string   `json:"n"`
-	E   string   `json:"e"`
-	X5c []string `json:"x5c"`
+	// http.HandlerFunc wraps a function so that it
+	// implements http.Handler interface
+	return http.HandlerFunc(fn)
 }
@@ -0,0 +1,286 @@
+// Package servertest provides helpers to test servers and controllers without
+// depending on external services.
+package servertest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/franklyner/ssf/server"
+)
+
+// DefaultTokenLifetime is the validity of tokens minted without an exp claim
+const DefaultTokenLifetime = time.Hour
+
+// Claims of a token
+type Claims = server.JWTClaims
+
+// Issuer is a local stand-in for an identity provider. It serves the OpenID discovery
+// document and the JWKS from an httptest.Server and mints signed tokens. Use its URL
+// as issuer of GetJwtAuth:
+//
+//	issuer := servertest.NewIssuer()
+//	defer issuer.Close()
+//	auth := server.GetJwtAuth(issuer.URL, validator)
+//	token, err := issuer.Token(servertest.Claims{"sub": "user-1"})
+type Issuer struct {
+	*httptest.Server
+	mutex      sync.Mutex
+	key        *Key
+	jwks       []server.JSONWebKeys
+	jwksFetchs int
+}
+
+// NewIssuer starts an issuer with an RS256 signing key. Like httptest.NewServer it
+// panics on failure. Close it at the end of the test.
+func NewIssuer() *Issuer {
+	key, err := NewKey("RS256")
+	if err != nil {
+		panic(fmt.Sprintf("servertest: failed to generate signing key: %v", err))
+	}
+	i := &Issuer{key: key, jwks: []server.JSONWebKeys{key.JWK()}}
+	i.Server = httptest.NewServer(http.HandlerFunc(i.serveHTTP))
+	return i
+}
+
+func (i *Issuer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	var body any
+	switch r.URL.Path {
+	case "/.well-known/openid-configuration":
+		body = map[string]string{
+			"issuer":   i.URL,
+			"jwks_uri": i.URL + "/.well-known/jwks.json",
+		}
+	case "/.well-known/jwks.json":
+		i.jwksFetchs++
+		body = server.Jwks{Keys: i.jwks}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+// Key returns the key tokens are currently signed with
+func (i *Issuer) Key() *Key {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return i.key
+}
+
+// RotateKey publishes a new key for the given algorithm and signs all further tokens
+// with it. The previous keys stay published until they are removed with Unpublish.
+func (i *Issuer) RotateKey(alg string) (*Key, error) {
+	key, err := NewKey(alg)
+	if err != nil {
+		return nil, err
+	}
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.key = key
+	i.jwks = append(i.jwks, key.JWK())
+	return key, nil
+}
+
+// Publish adds a key to the JWKS. Together with Key.JWK it allows to serve keys in
+// any representation, e.g. an RSA key only given by its certificate.
+func (i *Issuer) Publish(jwk server.JSONWebKeys) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.jwks = append(i.jwks, jwk)
+}
+
+// Unpublish removes the key with the given id from the JWKS
+func (i *Issuer) Unpublish(kid string) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	jwks := []server.JSONWebKeys{}
+	for _, jwk := range i.jwks {
+		if jwk.Kid != kid {
+			jwks = append(jwks, jwk)
+		}
+	}
+	i.jwks = jwks
+}
+
+// JWKSFetches returns how many times the JWKS was requested
+func (i *Issuer) JWKSFetches() int {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return i.jwksFetchs
+}
+
+// Token mints a token signed with the current key. The claims iss, iat and exp are
+// set to the issuer URL, now and now + DefaultTokenLifetime unless given. Pass an exp
+// in the past to get an expired token.
+func (i *Issuer) Token(claims Claims) (string, error) {
+	return i.TokenWithKey(i.Key(), claims)
+}
+
+// TokenWithKey mints a token like Token but signs it with the given key, which
+// doesn't need to be published.
+func (i *Issuer) TokenWithKey(key *Key, claims Claims) (string, error) {
+	now := time.Now()
+	c := Claims{
+		"iss": i.URL,
+		"iat": now.Unix(),
+		"exp": now.Add(DefaultTokenLifetime).Unix(),
+	}
+	for k, v := range claims {
+		c[k] = v
+	}
+	return key.Sign(c)
+}
+
+// Key is a signing key of the issuer. ID and Algorithm end up in the kid and alg
+// header of the tokens and can be changed to forge invalid tokens.
+type Key struct {
+	ID        string
+	Algorithm string
+	signer    crypto.Signer
+	cert      []byte
+}
+
+// NewKey generates a key for the given algorithm: a 2048 bit RSA key for RS256, RS384,
+// RS512, PS256, PS384 and PS512 or an EC key on the matching curve for ES256, ES384 and ES512.
+func NewKey(alg string) (*Key, error) {
+	var signer crypto.Signer
+	var err error
+	switch alg {
+	case "RS256", "RS384", "RS512", "PS256", "PS384", "PS512":
+		signer, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "ES256":
+		signer, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ES384":
+		signer, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case "ES512":
+		signer, err = ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %s", alg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 8)
+	_, err = rand.Read(id)
+	if err != nil {
+		return nil, err
+	}
+	key := &Key{
+		ID:        base64.RawURLEncoding.EncodeToString(id),
+		Algorithm: alg,
+		signer:    signer,
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: key.ID},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	key.cert, err = x509.CreateCertificate(rand.Reader, template, template, signer.Public(), signer)
+	if err != nil {
+		return nil, fmt.Errorf("error creating certificate: %w", err)
+	}
+	return key, nil
+}
+
+// Public returns the public key
+func (k *Key) Public() crypto.PublicKey {
+	return k.signer.Public()
+}
+
+// JWK returns the key as published in the JWKS, including a self signed certificate in x5c
+func (k *Key) JWK() server.JSONWebKeys {
+	jwk := server.JSONWebKeys{
+		Kid: k.ID,
+		Use: "sig",
+		Alg: k.Algorithm,
+		X5c: []string{base64.StdEncoding.EncodeToString(k.cert)},
+	}
+	switch pub := k.signer.Public().(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		jwk.Kty = "EC"
+		jwk.Crv = pub.Curve.Params().Name
+		jwk.X = base64.RawURLEncoding.EncodeToString(pub.X.FillBytes(make([]byte, size)))
+		jwk.Y = base64.RawURLEncoding.EncodeToString(pub.Y.FillBytes(make([]byte, size)))
+	}
+	return jwk
+}
+
+// Sign returns the compact serialization of a token with the given claims. No
+// claims are added.
+func (k *Key) Sign(claims Claims) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": k.Algorithm, "typ": "JWT", "kid": k.ID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("error marshaling claims: %w", err)
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	signature, err := k.sign(signingInput)
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func (k *Key) sign(signingInput string) ([]byte, error) {
+	var hash crypto.Hash
+	switch {
+	case strings.HasSuffix(k.Algorithm, "256"):
+		hash = crypto.SHA256
+	case strings.HasSuffix(k.Algorithm, "384"):
+		hash = crypto.SHA384
+	case strings.HasSuffix(k.Algorithm, "512"):
+		hash = crypto.SHA512
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %s", k.Algorithm)
+	}
+	h := hash.New()
+	h.Write([]byte(signingInput))
+	digest := h.Sum(nil)
+
+	switch priv := k.signer.(type) {
+	case *rsa.PrivateKey:
+		if strings.HasPrefix(k.Algorithm, "PS") {
+			return rsa.SignPSS(rand.Reader, priv, hash, digest, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+		return rsa.SignPKCS1v15(rand.Reader, priv, hash, digest)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, priv, digest)
+		if err != nil {
+			return nil, err
+		}
+		// JWS uses the fixed size concatenation of r and s instead of ASN.1
+		size := (priv.Curve.Params().BitSize + 7) / 8
+		signature := make([]byte, 2*size)
+		r.FillBytes(signature[:size])
+		s.FillBytes(signature[size:])
+		return signature, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %T", k.signer)
+}
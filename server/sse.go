@@ -0,0 +1,240 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConfigSSEHeartbeatInterval is the interval comments are sent on idle event streams to
+// keep proxies from closing the connection (default 15s)
+const ConfigSSEHeartbeatInterval = "sse_heartbeat_interval"
+
+const defaultSSEHeartbeatInterval = 15 * time.Second
+
+func loadSSEHeartbeatInterval(config Config) (time.Duration, error) {
+	heartbeat, err := config.GetDuration(ConfigSSEHeartbeatInterval)
+	if err != nil {
+		return 0, err
+	}
+	if heartbeat < 0 {
+		return 0, fmt.Errorf("invalid %s: %s, must not be negative", ConfigSSEHeartbeatInterval, heartbeat)
+	}
+	return heartbeat, nil
+}
+
+// ErrStreamClosed is returned when sending to a stream that was closed, e.g. because
+// the client disconnected or the server is shutting down
+var ErrStreamClosed = errors.New("stream closed")
+
+// SSEEvent is a single server-sent event. Data spanning multiple lines is sent as
+// multiple data fields. ID and Event must not contain line breaks.
+type SSEEvent struct {
+	ID    string
+	Event string // the event type, defaults to message on the client
+	Data  string
+	Retry time.Duration // reconnection time the client should use
+}
+
+// SSEStream writes server-sent events. Every event is flushed immediately. Heartbeats are
+// sent while the stream is idle. The stream ends when the client disconnects, the server
+// shuts down or the controller returns.
+type SSEStream struct {
+	ctx          *Context
+	w            http.ResponseWriter
+	rc           *http.ResponseController
+	writeTimeout time.Duration
+	mutex        sync.Mutex
+	done         chan struct{}
+	closeOnce    sync.Once
+	start        time.Time
+}
+
+// StartSSE sends the headers of an event stream and returns the stream to send events
+// with. The write timeout of the server is lifted for the stream and applied to every
+// event instead. Controllers should watch Done to stop producing events:
+//
+//	stream, err := ctx.StartSSE()
+//	if err != nil {
+//		ctx.SendJsonError(err)
+//		return
+//	}
+//	for {
+//		select {
+//		case <-stream.Done():
+//			return
+//		case update := <-updates:
+//			stream.Send(server.SSEEvent{Event: "progress", Data: update})
+//		}
+//	}
+func (ctx *Context) StartSSE() (*SSEStream, error) {
+	if ctx.IsResponseSent {
+		return nil, errors.New("response for this request was already sent")
+	}
+	if ctx.responseWriter == nil {
+		return nil, errors.New("no response writer to stream to")
+	}
+	heartbeat := ctx.Server.sseHeartbeat
+	if heartbeat == 0 {
+		heartbeat = defaultSSEHeartbeatInterval
+	}
+
+	stream := &SSEStream{
+		ctx:          ctx,
+		w:            ctx.responseWriter,
+		rc:           http.NewResponseController(ctx.responseWriter),
+		writeTimeout: ctx.Server.writeTimeout,
+		done:         make(chan struct{}),
+		start:        time.Now(),
+	}
+	header := ctx.responseWriter.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	header.Set("X-Accel-Buffering", "no") // disables response buffering of nginx
+	ctx.sendCode(http.StatusOK)
+	ctx.IsResponseSent = true
+	err := stream.flush()
+	if err != nil {
+		return nil, fmt.Errorf("response writer doesn't support streaming: %w", err)
+	}
+	ctx.stream = stream
+
+	go stream.run(heartbeat)
+	ctx.LogDebug("Started event stream")
+	return stream, nil
+}
+
+// run sends heartbeats and closes the stream if the client disconnects or the server shuts down
+func (st *SSEStream) run(heartbeat time.Duration) {
+	ticker := time.NewTicker(heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-st.done:
+			return
+		case <-st.ctx.Request.Context().Done():
+			st.Close()
+			return
+		case <-st.ctx.Server.getStreamStop():
+			st.Close()
+			return
+		case <-ticker.C:
+			err := st.write(": heartbeat\n\n")
+			if err != nil {
+				st.ctx.LogDebugf("Closing event stream after failed heartbeat: %s", err.Error())
+				st.Close()
+				return
+			}
+		}
+	}
+}
+
+// Done is closed when the stream ended
+func (st *SSEStream) Done() <-chan struct{} {
+	return st.done
+}
+
+// Send writes the event and flushes it to the client. Returns an error without sending
+// anything if ID or Event contain a line break, as they could inject further fields.
+func (st *SSEStream) Send(event SSEEvent) error {
+	if strings.ContainsAny(event.ID, "\r\n") || strings.ContainsAny(event.Event, "\r\n") {
+		return errors.New("id and event of server-sent events must not contain line breaks")
+	}
+	b := strings.Builder{}
+	if event.ID != "" {
+		b.WriteString("id: " + event.ID + "\n")
+	}
+	if event.Event != "" {
+		b.WriteString("event: " + event.Event + "\n")
+	}
+	if event.Retry > 0 {
+		b.WriteString("retry: " + strconv.FormatInt(event.Retry.Milliseconds(), 10) + "\n")
+	}
+	data := strings.ReplaceAll(strings.ReplaceAll(event.Data, "\r\n", "\n"), "\r", "\n")
+	for _, line := range strings.Split(data, "\n") {
+		b.WriteString("data: " + line + "\n")
+	}
+	b.WriteString("\n")
+	return st.write(b.String())
+}
+
+// SendJSON sends v marshaled as JSON as data of an event of the given type
+func (st *SSEStream) SendJSON(event string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("error marshaling event: %w", err)
+	}
+	return st.Send(SSEEvent{Event: event, Data: string(data)})
+}
+
+func (st *SSEStream) write(s string) error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	select {
+	case <-st.done:
+		return ErrStreamClosed
+	default:
+	}
+	if st.writeTimeout > 0 {
+		err := st.rc.SetWriteDeadline(time.Now().Add(st.writeTimeout))
+		if err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return err
+		}
+	}
+	_, err := st.w.Write([]byte(s))
+	if err != nil {
+		return err
+	}
+	return st.flush()
+}
+
+// flush sends buffered data. Lifts the write deadline until the next write, so idle
+// streams aren't killed by the write timeout of the server.
+func (st *SSEStream) flush() error {
+	err := st.rc.Flush()
+	if err != nil {
+		return err
+	}
+	err = st.rc.SetWriteDeadline(time.Time{})
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
+
+// Close ends the stream and records its duration. Called automatically when the
+// controller returns.
+func (st *SSEStream) Close() {
+	st.closeOnce.Do(func() {
+		duration := time.Since(st.start)
+		st.ctx.log(slog.LevelDebug, "Event stream closed", slog.Duration("stream_duration", duration))
+		st.ctx.Server.observeStream(st.ctx, "sse", duration)
+		st.mutex.Lock()
+		close(st.done)
+		st.mutex.Unlock()
+	})
+}
+
+// getStreamStop returns the channel closed when the server shuts down
+func (s *Server) getStreamStop() chan struct{} {
+	s.streamStopOnce.Do(func() {
+		s.streamStop = make(chan struct{})
+	})
+	return s.streamStop
+}
+
+// stopStreams ends all open streams. Registered as shutdown hook of the http server,
+// as streams would otherwise keep the shutdown waiting until it times out.
+func (s *Server) stopStreams() {
+	stop := s.getStreamStop()
+	s.stopStreamsOnce.Do(func() {
+		close(stop)
+	})
+}
@@ -1,9 +1,13 @@
 package server
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"runtime"
+	"runtime/debug"
 	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -61,7 +65,98 @@ func (s *StatusInformation) snapshot() map[string]int {
 	return ss
 }
 
-// StatusController shows status page
+// Build information shown on the status page. Set them at build time with:
+// go build -ldflags "-X github.com/franklyner/ssf/server.Version=1.2.3 -X github.com/franklyner/ssf/server.Commit=abc123"
+// If not set, the values are taken from the build info embedded by the go tool.
+var (
+	Version = ""
+	Commit  = ""
+)
+
+// BuildInfo describes the running binary
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	GoVersion string `json:"go_version"`
+}
+
+// StatusResponse is the JSON representation of the status page
+type StatusResponse struct {
+	RunningSince  time.Time          `json:"running_since"`
+	Uptime        string             `json:"uptime"`
+	UptimeSeconds int64              `json:"uptime_seconds"`
+	Build         BuildInfo          `json:"build"`
+	Controllers   []ControllerStatus `json:"controllers"`
+	Metrics       map[string]int     `json:"metrics"`
+}
+
+// ControllerStatus holds the status information of a single controller
+type ControllerStatus struct {
+	Name           string   `json:"name"`
+	Methods        []string `json:"methods"`
+	Path           string   `json:"path"`
+	Description    string   `json:"description"`
+	Count          int      `json:"count"`
+	Secured        bool     `json:"secured"`
+	RequiredScopes []string `json:"required_scopes,omitempty"`
+	RequiredRoles  []string `json:"required_roles,omitempty"`
+	Subdomains     []string `json:"subdomains,omitempty"`
+}
+
+// GetBuildInfo returns the build information of the running binary
+func GetBuildInfo() BuildInfo {
+	info := BuildInfo{
+		Version:   Version,
+		Commit:    Commit,
+		GoVersion: runtime.Version(),
+	}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	if info.Version == "" {
+		info.Version = bi.Main.Version
+	}
+	if info.Commit == "" {
+		for _, setting := range bi.Settings {
+			if setting.Key == "vcs.revision" {
+				info.Commit = setting.Value
+			}
+		}
+	}
+	return info
+}
+
+// GetStatus collects the status of the server
+func (s *Server) GetStatus() StatusResponse {
+	stats := s.statusInfo.snapshot()
+	uptime := time.Since(s.statusInfo.start)
+	status := StatusResponse{
+		RunningSince:  s.statusInfo.start,
+		Uptime:        uptime.Round(time.Second).String(),
+		UptimeSeconds: int64(uptime.Seconds()),
+		Build:         GetBuildInfo(),
+		Controllers:   []ControllerStatus{},
+	}
+	for _, ctr := range s.GetControllers() {
+		status.Controllers = append(status.Controllers, ControllerStatus{
+			Name:           ctr.Name,
+			Methods:        ctr.Methods,
+			Path:           ctr.Path,
+			Description:    ctr.Description,
+			Count:          stats[ctr.Metric],
+			Secured:        ctr.IsSecured,
+			RequiredScopes: ctr.RequiredScopes,
+			RequiredRoles:  ctr.RequiredRoles,
+			Subdomains:     ctr.Subdomains,
+		})
+		delete(stats, ctr.Metric)
+	}
+	status.Metrics = stats
+	return status
+}
+
+// StatusController shows status page. Renders HTML unless the Accept header prefers JSON.
 var StatusController Controller = Controller{
 	Name:      "StatusController",
 	Metric:    "status",
@@ -69,10 +164,21 @@ var StatusController Controller = Controller{
 	Methods:   []string{"GET"},
 	IsSecured: false,
 	ControllerFunc: func(ctx *Context) {
-		stats := ctx.StatusInformation.snapshot()
+		status := ctx.Server.GetStatus()
+		if prefersJSON(ctx.Request) {
+			content, err := json.Marshal(status)
+			if err != nil {
+				ctx.SendJsonError(fmt.Errorf("error marshalling status: %w", err))
+				return
+			}
+			ctx.SendJSONResponse(http.StatusOK, content)
+			return
+		}
+
 		html := strings.Builder{}
 		html.WriteString("<html><h1>Status</h1><br/>")
-		html.WriteString(fmt.Sprintf("Running since: %s<br/><br/>", ctx.StatusInformation.start.Format("2006-01-02 15:04:05")))
+		html.WriteString(fmt.Sprintf("Running since: %s<br/>", status.RunningSince.Format("2006-01-02 15:04:05")))
+		html.WriteString(fmt.Sprintf("Version: %s, Commit: %s, Go: %s<br/><br/>", status.Build.Version, status.Build.Commit, status.Build.GoVersion))
 		html.WriteString(
 			`<table>
 				<tr align="left">
@@ -81,10 +187,10 @@ var StatusController Controller = Controller{
 					<th>Path</th>
 					<th>Invokation Count</th>
 					<th>Description</th>
+					<th>Requirements</th>
 				</tr>`)
-		for _, ctr := range ctx.Server.GetControllers() {
-			html.WriteString(fmt.Sprintf("<tr><td>%s</td><td>%+v</td><td>%s</td><td align='center'>%d</td><td>%s</td></tr>", ctr.Name, ctr.Methods, ctr.Path, stats[ctr.Metric], ctr.Description))
-			delete(stats, ctr.Metric)
+		for _, ctr := range status.Controllers {
+			html.WriteString(fmt.Sprintf("<tr><td>%s</td><td>%+v</td><td>%s</td><td align='center'>%d</td><td>%s</td><td>%s</td></tr>", ctr.Name, ctr.Methods, ctr.Path, ctr.Count, ctr.Description, ctr.requirements()))
 		}
 		html.WriteString("</table>\n")
 		html.WriteString("<p><h2>Non Controller Metrics</h2></p>\n")
@@ -94,16 +200,68 @@ var StatusController Controller = Controller{
 					<th>Metric</th>
 					<th>Value</th>
 				</tr>`)
-		sortedMetrics := make([]string, 0, len(stats))
-		for metric, _ := range stats {
+		sortedMetrics := make([]string, 0, len(status.Metrics))
+		for metric := range status.Metrics {
 			sortedMetrics = append(sortedMetrics, metric)
 		}
 		slices.Sort(sortedMetrics)
 		for _, metric := range sortedMetrics {
-			html.WriteString(fmt.Sprintf("<tr><td>%s</td><td align='center'>%d</td></tr>", metric, stats[metric]))
+			html.WriteString(fmt.Sprintf("<tr><td>%s</td><td align='center'>%d</td></tr>", metric, status.Metrics[metric]))
 		}
 		html.WriteString("</table>\n")
 
 		ctx.SendHTMLResponse(http.StatusOK, []byte(html.String()))
 	},
 }
+
+// requirements describes the auth requirements of the controller for the status page
+func (c ControllerStatus) requirements() string {
+	reqs := []string{"public"}
+	if c.Secured {
+		reqs[0] = "authenticated"
+	}
+	if len(c.RequiredScopes) > 0 {
+		reqs = append(reqs, "scopes: "+strings.Join(c.RequiredScopes, " and "))
+	}
+	if len(c.RequiredRoles) > 0 {
+		reqs = append(reqs, "roles: "+strings.Join(c.RequiredRoles, " or "))
+	}
+	if len(c.Subdomains) > 0 {
+		reqs = append(reqs, "subdomains: "+strings.Join(c.Subdomains, ", "))
+	}
+	return strings.Join(reqs, ", ")
+}
+
+// prefersJSON evaluates the Accept header and reports whether application/json has a
+// higher quality than text/html. On a tie the one listed first wins.
+func prefersJSON(r *http.Request) bool {
+	jsonQ, htmlQ := -1.0, -1.0
+	jsonPos, htmlPos := 0, 0
+	for i, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if key == "q" {
+				parsed, err := strconv.ParseFloat(value, 64)
+				if err == nil {
+					q = parsed
+				}
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(mediaType)) {
+		case "application/json":
+			if q > jsonQ {
+				jsonQ, jsonPos = q, i
+			}
+		case "text/html":
+			if q > htmlQ {
+				htmlQ, htmlPos = q, i
+			}
+		}
+	}
+	if jsonQ <= 0 {
+		return false
+	}
+	return jsonQ > htmlQ || (jsonQ == htmlQ && jsonPos < htmlPos)
+}
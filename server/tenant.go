@@ -0,0 +1,123 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// ConfigBaseDomains lists the domains tenants are subdomains of, e.g. example.com for
+// <tenant>.example.com. Comma separated. Context.Subdomain stays empty without it.
+const ConfigBaseDomains = "base_domains"
+
+// ErrUnknownTenant is returned by a TenantResolver if there is no tenant for the subdomain.
+// The request is answered with 404.
+var ErrUnknownTenant = errors.New("unknown tenant")
+
+// TenantResolver loads the tenant of a subdomain. The result is available through
+// Context.Tenant. Errors other than ErrUnknownTenant result in a 500 response unless
+// they are a JSONErrorResponse.
+type TenantResolver func(ctx *Context, subdomain string) (any, error)
+
+// SetTenantResolver registers the resolver called for every request with a subdomain.
+// Must be called before the server is started.
+func (s *Server) SetTenantResolver(resolver TenantResolver) {
+	s.tenantResolver = resolver
+}
+
+// Tenant returns what the TenantResolver returned for the subdomain of the request or
+// nil if there is no subdomain or no resolver
+func (ctx *Context) Tenant() any {
+	return ctx.tenant
+}
+
+// extractSubdomain returns the part of the host in front of one of the base domains.
+// X-Forwarded-Host is used instead of Host with trust_proxy_headers=true, taking the entry
+// of the outermost trusted proxy like ClientIP.
+func (s *Server) extractSubdomain(r *http.Request) string {
+	if len(s.baseDomains) == 0 {
+		return ""
+	}
+	host := r.Host
+	if s.trustProxyHeaders {
+		if forwarded := s.forwardedValue(r, "X-Forwarded-Host"); forwarded != "" {
+			host = forwarded
+		}
+	}
+	host = strings.ToLower(strings.TrimSpace(host))
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, domain := range s.baseDomains {
+		if subdomain, found := strings.CutSuffix(host, "."+domain); found {
+			return subdomain
+		}
+	}
+	return ""
+}
+
+// matchesSubdomains returns a route matcher restricting the controller to its Subdomains.
+// Patterns use path.Match syntax, so * matches any subdomain and tenant-* all subdomains
+// starting with tenant-. Requests without subdomain only match the pattern "".
+func (s *Server) matchesSubdomains(c Controller) mux.MatcherFunc {
+	return func(r *http.Request, _ *mux.RouteMatch) bool {
+		subdomain := s.extractSubdomain(r)
+		if subdomain == "" {
+			return slices.Contains(c.Subdomains, "")
+		}
+		_, found := matchingSubdomainPattern(c.Subdomains, subdomain)
+		return found
+	}
+}
+
+func matchingSubdomainPattern(patterns []string, subdomain string) (string, bool) {
+	for _, pattern := range patterns {
+		matched, err := path.Match(strings.ToLower(pattern), subdomain)
+		if err == nil && matched {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+// tenantLabel is the tenant reported in metrics. As the subdomain is chosen by the client,
+// it's only used once the TenantResolver accepted it. Otherwise the matched pattern of
+// Controller.Subdomains or unknown is used, keeping the number of label values bounded.
+func (ctx *Context) tenantLabel() string {
+	if ctx.Subdomain == "" || ctx.tenantResolved {
+		return ctx.Subdomain
+	}
+	if pattern, found := matchingSubdomainPattern(ctx.Controller.Subdomains, ctx.Subdomain); found {
+		return pattern
+	}
+	return "unknown"
+}
+
+// resolveTenant calls the TenantResolver and sends an error response if it fails.
+// Returns false if the request must not be processed further.
+func (s *Server) resolveTenant(ctx *Context) bool {
+	if s.tenantResolver == nil || ctx.Subdomain == "" {
+		return true
+	}
+	tenant, err := s.tenantResolver(ctx, ctx.Subdomain)
+	if err == nil {
+		ctx.tenant = tenant
+		ctx.tenantResolved = true
+		return true
+	}
+	if errors.Is(err, ErrUnknownTenant) {
+		err = JSONErrorResponse{
+			Code:       http.StatusNotFound,
+			Message:    "unknown_tenant",
+			LogMessage: fmt.Sprintf("no tenant for subdomain %s: %s", ctx.Subdomain, err.Error()),
+		}
+	}
+	ctx.SendJsonError(err)
+	return false
+}
@@ -0,0 +1,242 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"gorm.io/gorm"
+)
+
+// Config properties of the tracing. Tracing is disabled unless an exporter is configured.
+const (
+	ConfigTracingExporter = "tracing_exporter"
+	// ConfigTracingEndpoint is the host:port of the OTLP/HTTP collector. Defaults to the
+	// OTEL_EXPORTER_OTLP_ENDPOINT environment variable or localhost:4318.
+	ConfigTracingEndpoint    = "tracing_endpoint"
+	ConfigTracingServiceName = "tracing_service_name"
+)
+
+// Supported values of the tracing_exporter config property
+const (
+	TracingExporterOTLP   = "otlp"
+	TracingExporterStdout = "stdout"
+)
+
+// TracerName is the instrumentation scope of all spans created by the server
+const TracerName = "github.com/franklyner/ssf/server"
+
+const gormSpanKey = "ssf:span"
+
+// CreateTracerProvider creates a TracerProvider exporting to the configured exporter.
+// Returns nil if no exporter is configured.
+func CreateTracerProvider(config Config) (*sdktrace.TracerProvider, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch config.Get(ConfigTracingExporter) {
+	case "":
+		return nil, nil
+	case TracingExporterOTLP:
+		opts := []otlptracehttp.Option{}
+		if endpoint := config.Get(ConfigTracingEndpoint); endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(endpoint), otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	case TracingExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	default:
+		return nil, fmt.Errorf("invalid tracing exporter %s. Expecting %s or %s", config.Get(ConfigTracingExporter), TracingExporterOTLP, TracingExporterStdout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error creating tracing exporter: %w", err)
+	}
+
+	res := resource.Default()
+	if name := config.Get(ConfigTracingServiceName); name != "" {
+		res, err = resource.Merge(res, resource.NewSchemaless(attribute.String("service.name", name)))
+		if err != nil {
+			return nil, fmt.Errorf("error creating tracing resource: %w", err)
+		}
+	}
+	return sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res)), nil
+}
+
+// EnableTracing creates a span for every controller execution and for every gorm call
+// of the repository. The W3C traceparent header of incoming requests is honored.
+// Tests can pass a TracerProvider with an in-memory exporter (sdk/trace/tracetest).
+// Must be called before the server is started.
+func (s *Server) EnableTracing(tp trace.TracerProvider) {
+	s.tracer = tp.Tracer(TracerName)
+	if s.repository != nil {
+		err := s.repository.enableTracing(s.tracer)
+		if err != nil {
+			s.Logger().Error("Error enabling tracing of the repository: " + err.Error())
+		}
+	}
+}
+
+// IsTracingEnabled returns true if EnableTracing has been called or an exporter is configured
+func (s *Server) IsTracingEnabled() bool {
+	return s.tracer != nil
+}
+
+func (s *Server) getTracer() trace.Tracer {
+	if s.tracer == nil {
+		return noop.NewTracerProvider().Tracer(TracerName)
+	}
+	return s.tracer
+}
+
+// shutdownTracerProvider flushes the spans of the tracer provider created from the config
+func (s *Server) shutdownTracerProvider(ctx context.Context) error {
+	if s.tracerProvider == nil {
+		return nil
+	}
+	err := s.tracerProvider.Shutdown(ctx)
+	if err != nil {
+		return fmt.Errorf("error shutting down tracer provider: %w", err)
+	}
+	return nil
+}
+
+// extractTraceContext continues the trace of the caller if the request carries a traceparent header
+func extractTraceContext(r *http.Request) *http.Request {
+	ctx := propagation.TraceContext{}.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	return r.WithContext(ctx)
+}
+
+// startControllerSpan starts the span of the controller execution. The trace and span
+// ids are added to the log attributes.
+func (ctx *Context) startControllerSpan() trace.Span {
+	if !ctx.Server.IsTracingEnabled() {
+		return ctx.Span()
+	}
+	spanCtx, span := ctx.Server.getTracer().Start(ctx.Request.Context(), ctx.Request.Method+" "+ctx.Route,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", ctx.Request.Method),
+			attribute.String("http.route", ctx.Route),
+			attribute.String("url.path", ctx.Request.URL.Path),
+			attribute.String("ssf.controller", ctx.Controller.Name),
+			attribute.String("ssf.request_id", ctx.GetRequestID()),
+		),
+	)
+	ctx.Request = ctx.Request.WithContext(spanCtx)
+	sc := span.SpanContext()
+	ctx.AddLogAttrs("trace_id", sc.TraceID().String(), "span_id", sc.SpanID().String())
+	return span
+}
+
+func (ctx *Context) endControllerSpan(span trace.Span) {
+	if !span.IsRecording() {
+		return
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", ctx.ResponseCode))
+	if ctx.ResponseCode >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, strconv.Itoa(ctx.ResponseCode))
+	}
+	span.End()
+}
+
+// Span returns the span of the current controller execution. If tracing is disabled,
+// a no-op span is returned, so it's always safe to use.
+func (ctx *Context) Span() trace.Span {
+	return trace.SpanFromContext(ctx.Request.Context())
+}
+
+// TraceContext returns a context.Context carrying the current span. Pass it to
+// outgoing calls, e.g. ctx.Repository.WithContext(ctx.TraceContext()), to have
+// their spans show up as children of the controller span.
+func (ctx *Context) TraceContext() context.Context {
+	return ctx.Request.Context()
+}
+
+// StartSpan starts a child span of the current span. The caller must end it.
+func (ctx *Context) StartSpan(name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return ctx.Server.getTracer().Start(ctx.TraceContext(), name, opts...)
+}
+
+// WithContext returns a gorm session bound to the given context. If tracing is enabled,
+// spans of the queries become children of the span carried by the context.
+func (r *Repository) WithContext(ctx context.Context) *gorm.DB {
+	return r.DB.WithContext(ctx)
+}
+
+// enableTracing registers gorm callbacks creating a span per DB operation
+func (r *Repository) enableTracing(tracer trace.Tracer) error {
+	if r.DB == nil {
+		return errors.New("repository has no DB")
+	}
+	alreadyRegistered := r.tracer != nil
+	r.tracer = tracer
+	if alreadyRegistered {
+		return nil
+	}
+
+	cb := r.DB.Callback()
+	return errors.Join(
+		cb.Create().Before("gorm:create").Register("ssf:before_create", r.beforeGormCallback("create")),
+		cb.Create().After("gorm:create").Register("ssf:after_create", afterGormCallback),
+		cb.Query().Before("gorm:query").Register("ssf:before_query", r.beforeGormCallback("query")),
+		cb.Query().After("gorm:query").Register("ssf:after_query", afterGormCallback),
+		cb.Update().Before("gorm:update").Register("ssf:before_update", r.beforeGormCallback("update")),
+		cb.Update().After("gorm:update").Register("ssf:after_update", afterGormCallback),
+		cb.Delete().Before("gorm:delete").Register("ssf:before_delete", r.beforeGormCallback("delete")),
+		cb.Delete().After("gorm:delete").Register("ssf:after_delete", afterGormCallback),
+		cb.Row().Before("gorm:row").Register("ssf:before_row", r.beforeGormCallback("row")),
+		cb.Row().After("gorm:row").Register("ssf:after_row", afterGormCallback),
+		cb.Raw().Before("gorm:raw").Register("ssf:before_raw", r.beforeGormCallback("raw")),
+		cb.Raw().After("gorm:raw").Register("ssf:after_raw", afterGormCallback),
+	)
+}
+
+func (r *Repository) beforeGormCallback(operation string) func(db *gorm.DB) {
+	return func(db *gorm.DB) {
+		ctx := db.Statement.Context
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		ctx, span := r.tracer.Start(ctx, "gorm."+operation,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				attribute.String("db.system", "mysql"),
+				attribute.String("db.operation.name", operation),
+			),
+		)
+		db.Statement.Context = ctx
+		db.InstanceSet(gormSpanKey, span)
+	}
+}
+
+func afterGormCallback(db *gorm.DB) {
+	value, ok := db.InstanceGet(gormSpanKey)
+	if !ok {
+		return
+	}
+	span, ok := value.(trace.Span)
+	if !ok {
+		return
+	}
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("db.collection.name", db.Statement.Table),
+		attribute.String("db.query.text", db.Statement.SQL.String()),
+		attribute.Int64("db.rows_affected", db.Statement.RowsAffected),
+	)
+	if db.Error != nil && !errors.Is(db.Error, gorm.ErrRecordNotFound) {
+		span.RecordError(db.Error)
+		span.SetStatus(codes.Error, db.Error.Error())
+	}
+}
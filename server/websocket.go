@@ -0,0 +1,279 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Config properties of WebSocket connections
+const (
+	// ConfigWebSocketPingInterval is the interval pings are sent to the client. Connections
+	// not answering within twice the interval are closed (default 30s).
+	ConfigWebSocketPingInterval = "websocket_ping_interval"
+	// ConfigWebSocketMaxMessageSize limits the size of received messages in bytes (default 1MB).
+	// Larger messages close the connection.
+	ConfigWebSocketMaxMessageSize = "websocket_max_message_size"
+)
+
+const (
+	defaultWebSocketPingInterval   = 30 * time.Second
+	defaultWebSocketMaxMessageSize = 1 << 20
+	webSocketWriteTimeout          = 10 * time.Second
+)
+
+// Message types of WebSocket messages
+const (
+	TextMessage   = websocket.TextMessage
+	BinaryMessage = websocket.BinaryMessage
+)
+
+// WebSocketFunc handles an upgraded connection. The connection is closed when it returns.
+type WebSocketFunc func(ctx *Context, conn *WebSocketConn)
+
+// WebSocketConn is a WebSocket connection bound to the Context of the upgrade request.
+// The connection is read continuously, so pongs and close messages of the client are
+// processed and Done fires even if the handler only sends messages. Reads must happen
+// from a single goroutine, writes are safe for concurrent use.
+type WebSocketConn struct {
+	ctx        *Context
+	conn       *websocket.Conn
+	writeMutex sync.Mutex
+	messages   chan webSocketMessage
+	readErr    error // set before messages is closed
+	done       chan struct{}
+	closeOnce  sync.Once
+	start      time.Time
+}
+
+type webSocketMessage struct {
+	messageType int
+	data        []byte
+}
+
+// webSocketOptions are the WebSocket config properties, 0 meaning the default
+type webSocketOptions struct {
+	pingInterval   time.Duration
+	maxMessageSize int64
+}
+
+func loadWebSocketOptions(config Config) (webSocketOptions, error) {
+	opts := webSocketOptions{}
+	var err error
+	opts.pingInterval, err = config.GetDuration(ConfigWebSocketPingInterval)
+	if err != nil {
+		return opts, err
+	}
+	if opts.pingInterval < 0 {
+		return opts, fmt.Errorf("invalid %s: %s, must not be negative", ConfigWebSocketPingInterval, opts.pingInterval)
+	}
+	value := config.Get(ConfigWebSocketMaxMessageSize)
+	if value == "" {
+		return opts, nil
+	}
+	opts.maxMessageSize, err = strconv.ParseInt(value, 10, 64)
+	if err != nil || opts.maxMessageSize < 0 {
+		return opts, fmt.Errorf("invalid %s: %s, must be a number of bytes", ConfigWebSocketMaxMessageSize, value)
+	}
+	return opts, nil
+}
+
+// serveWebSocket upgrades the connection and runs the WebSocketFunc of the controller.
+// Origins are checked against the CORS configuration of the controller. Without CORS
+// only same-origin requests are accepted.
+func (ctx *Context) serveWebSocket(handler WebSocketFunc) {
+	pingInterval := ctx.Server.webSocketOptions.pingInterval
+	maxSize := ctx.Server.webSocketOptions.maxMessageSize
+	if pingInterval == 0 {
+		pingInterval = defaultWebSocketPingInterval
+	}
+	if maxSize == 0 {
+		maxSize = defaultWebSocketMaxMessageSize
+	}
+
+	upgrader := websocket.Upgrader{}
+	if cors := ctx.Server.getCORSOptions(ctx.Controller); cors != nil {
+		upgrader.CheckOrigin = func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			return origin == "" || cors.isOriginAllowed(origin)
+		}
+	}
+	responseHeader := http.Header{}
+	responseHeader.Set(HeaderRequestID, ctx.GetRequestID())
+	ctx.IsResponseSent = true
+	// added while http.Server still tracks the request, so Shutdown can't miss the handler
+	ctx.Server.webSockets.Add(1)
+	defer ctx.Server.webSockets.Done()
+	conn, err := upgrader.Upgrade(ctx.responseWriter, ctx.Request, responseHeader)
+	if err != nil {
+		// the upgrader already sent an error response
+		ctx.LogWarnf("WebSocket upgrade failed: %s", err.Error())
+		return
+	}
+	ctx.ResponseCode = http.StatusSwitchingProtocols
+
+	wsc := &WebSocketConn{
+		ctx:      ctx,
+		conn:     conn,
+		messages: make(chan webSocketMessage),
+		done:     make(chan struct{}),
+		start:    time.Now(),
+	}
+	conn.SetReadLimit(maxSize)
+	conn.SetReadDeadline(time.Now().Add(2 * pingInterval))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * pingInterval))
+	})
+	go wsc.readLoop()
+	go wsc.keepAlive(pingInterval)
+	ctx.LogDebug("WebSocket connected")
+
+	defer wsc.Close(websocket.CloseNormalClosure, "")
+	handler(ctx, wsc)
+}
+
+// waitForWebSockets waits until all WebSocket handlers returned. Hijacked connections
+// aren't tracked by http.Server, so its Shutdown doesn't wait for them.
+func (s *Server) waitForWebSockets(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.webSockets.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("error waiting for WebSocket handlers: %w", ctx.Err())
+	}
+}
+
+// readLoop reads messages and hands them to ReadMessage. Closes the connection once
+// reading fails, e.g. because the client closed it or stopped answering pings.
+func (c *WebSocketConn) readLoop() {
+	defer close(c.messages)
+	for {
+		messageType, data, err := c.conn.ReadMessage()
+		if err != nil {
+			c.readErr = err
+			c.Close(closeCode(err), "")
+			return
+		}
+		c.ctx.Server.countWebSocketMessage(c.ctx, "received")
+		select {
+		case c.messages <- webSocketMessage{messageType: messageType, data: data}:
+		case <-c.done:
+			c.readErr = ErrStreamClosed
+			return
+		}
+	}
+}
+
+// keepAlive sends pings and closes the connection when the server shuts down
+func (c *WebSocketConn) keepAlive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-c.ctx.Server.getStreamStop():
+			c.Close(websocket.CloseGoingAway, "server shutting down")
+			return
+		case <-ticker.C:
+			c.writeMutex.Lock()
+			err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(webSocketWriteTimeout))
+			c.writeMutex.Unlock()
+			if err != nil {
+				c.ctx.LogDebugf("Closing WebSocket after failed ping: %s", err.Error())
+				c.Close(websocket.CloseGoingAway, "")
+				return
+			}
+		}
+	}
+}
+
+// Done is closed when the connection was closed
+func (c *WebSocketConn) Done() <-chan struct{} {
+	return c.done
+}
+
+// ReadMessage blocks until the next message arrives. Returns an error once the
+// connection is closed, the client stops answering pings or a message exceeds the limit.
+func (c *WebSocketConn) ReadMessage() (messageType int, data []byte, err error) {
+	msg, ok := <-c.messages
+	if !ok {
+		return 0, nil, c.readErr
+	}
+	return msg.messageType, msg.data, nil
+}
+
+// ReadJSON reads the next message and unmarshals it into v
+func (c *WebSocketConn) ReadJSON(v any) error {
+	_, data, err := c.ReadMessage()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// WriteMessage sends a message of the given type (TextMessage or BinaryMessage)
+func (c *WebSocketConn) WriteMessage(messageType int, data []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(webSocketWriteTimeout))
+	err := c.conn.WriteMessage(messageType, data)
+	if err != nil {
+		return err
+	}
+	c.ctx.Server.countWebSocketMessage(c.ctx, "sent")
+	return nil
+}
+
+// WriteJSON sends v marshaled as JSON in a text message
+func (c *WebSocketConn) WriteJSON(v any) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(webSocketWriteTimeout))
+	err := c.conn.WriteJSON(v)
+	if err != nil {
+		return err
+	}
+	c.ctx.Server.countWebSocketMessage(c.ctx, "sent")
+	return nil
+}
+
+// Close sends a close message with the given code (see RFC 6455) and closes the
+// connection. Called automatically when the WebSocketFunc returns.
+func (c *WebSocketConn) Close(code int, reason string) {
+	c.closeOnce.Do(func() {
+		c.writeMutex.Lock()
+		c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+		c.writeMutex.Unlock()
+		c.conn.Close()
+		duration := time.Since(c.start)
+		c.ctx.log(slog.LevelDebug, "WebSocket closed", slog.Int("close_code", code), slog.Duration("stream_duration", duration))
+		c.ctx.Server.observeStream(c.ctx, "websocket", duration)
+		close(c.done)
+	})
+}
+
+// closeCode returns the code to answer a failed read with
+func closeCode(err error) int {
+	var closeErr *websocket.CloseError
+	switch {
+	case errors.As(err, &closeErr):
+		return websocket.CloseNormalClosure
+	case errors.Is(err, websocket.ErrReadLimit):
+		return websocket.CloseMessageTooBig
+	}
+	return websocket.CloseGoingAway
+}
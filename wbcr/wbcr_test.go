@@ -1,9 +1,12 @@
 package wbcr
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/franklyner/ssf/server"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 const dburi = "" // replace with real url. NEVER STORE TO GIT
@@ -115,3 +118,96 @@ func TestLifecycle(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+// mapPersister keeps the values in memory
+type mapPersister struct {
+	values    map[string]SomeMapper
+	createErr error
+}
+
+func (p *mapPersister) Create(ctx *server.Context, value *SomeMapper) (SomeMapper, error) {
+	if p.createErr != nil {
+		return SomeMapper{}, p.createErr
+	}
+	p.values[value.SomeID] = *value
+	return *value, nil
+}
+func (p *mapPersister) Update(ctx *server.Context, value *SomeMapper) (SomeMapper, error) {
+	return p.Create(ctx, value)
+}
+func (p *mapPersister) Get(ctx *server.Context, key string) (SomeMapper, error) {
+	v, ok := p.values[key]
+	if !ok {
+		return v, ErrNotFound
+	}
+	return v, nil
+}
+func (p *mapPersister) GetAll(ctx *server.Context) ([]*SomeMapper, error) {
+	all := []*SomeMapper{}
+	for _, v := range p.values {
+		all = append(all, &v)
+	}
+	return all, nil
+}
+func (p *mapPersister) Delete(ctx *server.Context, key string) error {
+	delete(p.values, key)
+	return nil
+}
+
+func TestGetByKeyTracing(t *testing.T) {
+	srv := server.BlankServer()
+	exporter := tracetest.NewInMemoryExporter()
+	srv.EnableTracing(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	ctx := srv.InitNonRequestContext()
+
+	p := &mapPersister{values: map[string]SomeMapper{"first": {SomeID: "first", SomeValue: "haha"}}}
+	cache := CreateWBCacheRepository[string, SomeMapper](p)
+	for i := 0; i < 2; i++ {
+		_, err := cache.GetByKey(ctx, "first")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans but got %d", len(spans))
+	}
+	for i, expectHit := range []bool{false, true} {
+		found := false
+		for _, a := range spans[i].Attributes {
+			if a.Key == "cache.hit" {
+				found = true
+				if a.Value.AsBool() != expectHit {
+					t.Errorf("span %d: expected cache.hit=%t", i, expectHit)
+				}
+			}
+		}
+		if spans[i].Name != "wbcr.GetByKey" || !found {
+			t.Errorf("unexpected span %s: %+v", spans[i].Name, spans[i].Attributes)
+		}
+	}
+}
+
+func TestInsertError(t *testing.T) {
+	srv := server.BlankServer()
+	ctx := srv.InitNonRequestContext()
+	failure := errors.New("database down")
+	p := &mapPersister{values: map[string]SomeMapper{}, createErr: failure}
+	cache := CreateWBCacheRepository[string, SomeMapper](p)
+
+	err := cache.Insert(ctx, &SomeMapper{SomeID: "first", SomeValue: "haha"})
+	if !errors.Is(err, failure) {
+		t.Fatalf("expected the error of the persister but got %v", err)
+	}
+	_, err = cache.GetByKey(ctx, "first")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("failed insert must not be cached but got %v", err)
+	}
+
+	p.createErr = nil
+	err = cache.Insert(ctx, &SomeMapper{SomeID: "first", SomeValue: "haha"})
+	if err != nil {
+		t.Errorf("retrying the insert failed: %s", err)
+	}
+}
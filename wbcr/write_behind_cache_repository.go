@@ -1,11 +1,15 @@
 package wbcr
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
 
 	"github.com/franklyner/ssf/server"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"gorm.io/gorm"
 )
 
@@ -46,11 +50,12 @@ type Persister[K comparable, V any, PT Keyer[K, V]] interface {
 }
 
 type ExtendablePersister[K comparable, V any, PT Keyer[K, V]] struct {
-	IntCreate func(*server.Context, K, PT) error
-	IntUpdate func(*server.Context, K, PT) (V, error)
-	IntGet    func(ctx *server.Context, key K) (V, error)
-	IntGetAll func(ctx *server.Context) ([]PT, error)
-	IntDelete func(ctx *server.Context, key K) error
+	IntCreate      func(*server.Context, K, PT) error
+	IntUpdate      func(*server.Context, K, PT) (V, error)
+	IntGet         func(ctx *server.Context, key K) (V, error)
+	IntGetAll      func(ctx *server.Context) ([]PT, error)
+	IntDelete      func(ctx *server.Context, key K) error
+	IntCheckHealth func(ctx context.Context) error
 }
 
 func CreateWBCacheRepository[K comparable, V any, PT Keyer[K, V]](persister Persister[K, V, PT]) *WBCacheRepository[K, V, PT] {
@@ -74,8 +79,14 @@ func (wbcr *WBCacheRepository[K, V, PT]) GetAllKnownKeys(ctx *server.Context, en
 	return keys, nil
 }
 
+// GetByKey returns the cached value or fetches it from the persister. If tracing is
+// enabled, a span records whether the value was found in the cache.
 func (wbcr *WBCacheRepository[K, V, PT]) GetByKey(ctx *server.Context, key K) (V, error) {
+	_, span := ctx.StartSpan("wbcr.GetByKey", trace.WithAttributes(attribute.String("cache.key", fmt.Sprint(key))))
+	defer span.End()
+
 	v, found := wbcr.repo[key]
+	span.SetAttributes(attribute.Bool("cache.hit", found))
 	var err error
 	if !found {
 		e := new(V)
@@ -84,6 +95,10 @@ func (wbcr *WBCacheRepository[K, V, PT]) GetByKey(ctx *server.Context, key K) (V
 		}
 		v, err = wbcr.persister.Get(ctx, key)
 		if err != nil {
+			if !errors.Is(err, ErrNotFound) {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+			}
 			return *e, err
 		}
 		wbcr.repo[key] = v
@@ -100,7 +115,7 @@ func (wbcr *WBCacheRepository[K, V, PT]) Insert(ctx *server.Context, value PT) e
 
 	v, err := wbcr.persister.Create(ctx, value)
 	if err != nil {
-		fmt.Errorf("error persisting (key: %v): %w", key, err)
+		return fmt.Errorf("error persisting (key: %v): %w", key, err)
 	}
 	wbcr.repo[key] = v
 	return nil
@@ -153,6 +168,16 @@ func (wbcr *WBCacheRepository[K, V, PT]) Search(ctx *server.Context, searcher fu
 	return ret, nil
 }
 
+// CheckHealth checks the persister if it implements server.HealthChecker. This allows
+// to register the cache with server.RegisterHealthCheck.
+func (wbcr *WBCacheRepository[K, V, PT]) CheckHealth(ctx context.Context) error {
+	checker, ok := wbcr.persister.(server.HealthChecker)
+	if !ok {
+		return nil
+	}
+	return checker.CheckHealth(ctx)
+}
+
 func (wbcr *WBCacheRepository[K, V, PT]) ensureLoaded(ctx *server.Context) error {
 	if !wbcr.hasFetchedAll {
 		vals, err := wbcr.persister.GetAll(ctx)
@@ -199,6 +224,13 @@ func (e *ExtendablePersister[K, V, PT]) Delete(ctx *server.Context, key K) error
 	return e.IntDelete(ctx, key)
 }
 
+func (e *ExtendablePersister[K, V, PT]) CheckHealth(ctx context.Context) error {
+	if e.IntCheckHealth == nil {
+		return nil
+	}
+	return e.IntCheckHealth(ctx)
+}
+
 type GormPersister[K comparable, V any, PT Keyer[K, V]] struct {
 	repository *server.Repository
 }
@@ -220,8 +252,15 @@ func (p *GormPersister[K, V, PT]) RunMigrationInternalRepo() {
 	}
 }
 
+func (p *GormPersister[K, V, PT]) CheckHealth(ctx context.Context) error {
+	if p.repository == nil {
+		return errors.New("no repository set")
+	}
+	return p.repository.CheckHealth(ctx)
+}
+
 func (p *GormPersister[K, V, PT]) Create(ctx *server.Context, value PT) (V, error) {
-	db := p.repository.DB
+	db := p.repository.WithContext(ctx.TraceContext())
 	res := db.Create(value)
 	if res.Error != nil {
 		e := new(V)
@@ -233,7 +272,7 @@ func (p *GormPersister[K, V, PT]) Create(ctx *server.Context, value PT) (V, erro
 	return value.GetValue(), nil
 }
 func (p *GormPersister[K, V, PT]) Update(ctx *server.Context, value PT) (V, error) {
-	db := p.repository.DB
+	db := p.repository.WithContext(ctx.TraceContext())
 	empty := new(V)
 	res := db.Save(&value) // Save is an upsert
 	if res.Error != nil {
@@ -243,7 +282,7 @@ func (p *GormPersister[K, V, PT]) Update(ctx *server.Context, value PT) (V, erro
 	return value.GetValue(), nil
 }
 func (p *GormPersister[K, V, PT]) Get(ctx *server.Context, key K) (V, error) {
-	db := p.repository.DB
+	db := p.repository.WithContext(ctx.TraceContext())
 	empty := new(V)
 	value := new(PT)
 	v := *value
@@ -259,7 +298,7 @@ func (p *GormPersister[K, V, PT]) Get(ctx *server.Context, key K) (V, error) {
 	return v.GetValue(), nil
 }
 func (p *GormPersister[K, V, PT]) GetAll(ctx *server.Context) ([]PT, error) {
-	db := p.repository.DB
+	db := p.repository.WithContext(ctx.TraceContext())
 	all := []PT{}
 	res := db.Find(&all)
 	if res.Error != nil {
@@ -268,7 +307,7 @@ func (p *GormPersister[K, V, PT]) GetAll(ctx *server.Context) ([]PT, error) {
 	return all, nil
 }
 func (p *GormPersister[K, V, PT]) Delete(ctx *server.Context, key K) error {
-	db := p.repository.DB
+	db := p.repository.WithContext(ctx.TraceContext())
 	v := new(V)
 	keyName := (*new(PT)).GetKeyName()
 	res := db.Delete(v, keyName, key)